@@ -0,0 +1,240 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"pkt-checkout/callback"
+	"pkt-checkout/database"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func (s *Server) getCallbackEvents(c *fiber.Ctx) error {
+	// Fetch account for apiKey
+	account, err := s.authenticateRequest(c, database.ApiKeyScopeAdmin)
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// List subscribed events
+	var events []database.CallbackEvent
+	for _, event := range database.CallbackEvents() {
+		if account.SubscribesTo(event) {
+			events = append(events, event)
+		}
+	}
+
+	return c.JSON(struct {
+		Events []database.CallbackEvent `json:"events"`
+	}{
+		Events: events,
+	})
+}
+
+func (s *Server) updateCallbackEvents(c *fiber.Ctx) error {
+	// Fetch account for apiKey and validate the signature
+	account, err := s.authenticateSignedRequest(c, database.ApiKeyScopeAdmin)
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Expected arguments
+	var arguments struct {
+		Events []database.CallbackEvent `json:"events"`
+	}
+	if err = json.Unmarshal(c.Request().Body(), &arguments); err != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", "Provided request body unexpected"))
+	}
+
+	// Validate events
+	events, apiError := validateCallbackEvents(arguments.Events)
+	if apiError != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(apiError)
+	}
+
+	// An empty list subscribes to all events
+	account.CallbackEvents = events
+	if err = s.Database.UpdateAccountCallbackEvents(&account); err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	return s.getCallbackEvents(c)
+}
+
+func (s *Server) getCallbackRetryPolicy(c *fiber.Ctx) error {
+	// Fetch account for apiKey
+	account, err := s.authenticateRequest(c, database.ApiKeyScopeAdmin)
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Effective policy of the account
+	policy, err := callback.NewRetryPolicy().WithOverride(account.CallbackRetryPolicy)
+	if err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	return c.JSON(policy)
+}
+
+func (s *Server) updateCallbackRetryPolicy(c *fiber.Ctx) error {
+	// Fetch account for apiKey and validate the signature
+	account, err := s.authenticateSignedRequest(c, database.ApiKeyScopeAdmin)
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Expected arguments, fields left out fall back to the global policy
+	override := c.Request().Body()
+	if !json.Valid(override) {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", "Provided request body unexpected"))
+	}
+	compactOverride := bytes.Buffer{}
+	json.Compact(&compactOverride, override)
+
+	// Validate the resulting policy
+	if _, err := callback.NewRetryPolicy().WithOverride(compactOverride.String()); err != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", fmt.Sprintf("Callback retry policy invalid: %s", err.Error())))
+	}
+
+	// An empty object reverts to the global policy
+	account.CallbackRetryPolicy = compactOverride.String()
+	if account.CallbackRetryPolicy == "{}" {
+		account.CallbackRetryPolicy = ""
+	}
+	if err = s.Database.UpdateAccountCallbackRetryPolicy(&account); err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	return s.getCallbackRetryPolicy(c)
+}
+
+func (s *Server) getCallbackAcknowledgement(c *fiber.Ctx) error {
+	// Fetch account for apiKey
+	account, err := s.authenticateRequest(c, database.ApiKeyScopeAdmin)
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Effective acknowledgement of the account
+	return c.JSON(struct {
+		Acknowledgement callback.Acknowledgement `json:"acknowledgement"`
+	}{
+		Acknowledgement: s.Callbacks.Acknowledgement.WithOverride(account.CallbackAcknowledgement),
+	})
+}
+
+func (s *Server) updateCallbackAcknowledgement(c *fiber.Ctx) error {
+	// Fetch account for apiKey and validate the signature
+	account, err := s.authenticateSignedRequest(c, database.ApiKeyScopeAdmin)
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Expected arguments
+	var arguments struct {
+		Acknowledgement callback.Acknowledgement `json:"acknowledgement"`
+	}
+	if err = json.Unmarshal(c.Request().Body(), &arguments); err != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", "Provided request body unexpected"))
+	}
+
+	// Validate acknowledgement, an empty one reverts to the global setting
+	if len(arguments.Acknowledgement) > 0 {
+		if err := arguments.Acknowledgement.Validate(); err != nil {
+			c.Response().SetStatusCode(400)
+			return c.JSON(craftApiError("processing_error", fmt.Sprintf("Callback acknowledgement invalid: %s", err.Error())))
+		}
+	}
+
+	account.CallbackAcknowledgement = string(arguments.Acknowledgement)
+	if err = s.Database.UpdateAccountCallbackAcknowledgement(&account); err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	return s.getCallbackAcknowledgement(c)
+}
+
+func (s *Server) rotateCallbackSecret(c *fiber.Ctx) error {
+	// Fetch account for apiKey and validate the signature
+	account, err := s.authenticateSignedRequest(c, database.ApiKeyScopeAdmin)
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Expected arguments
+	arguments := struct {
+		PreviousSecretLifetime uint16 `json:"previousSecretLifetime"`
+	}{
+		PreviousSecretLifetime: 1440,
+	}
+	if len(c.Request().Body()) > 0 {
+		if err = json.Unmarshal(c.Request().Body(), &arguments); err != nil {
+			c.Response().SetStatusCode(400)
+			return c.JSON(craftApiError("processing_error", "Provided request body unexpected"))
+		}
+	}
+
+	// Validate previous secret lifetime
+	if arguments.PreviousSecretLifetime > 10080 {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", "Previous secret lifetime must be within 0 to 10080 minutes"))
+	}
+
+	// Keep signing with the previous secrets for the remaining lifetime
+	expirationTime := time.Now().Add(time.Duration(arguments.PreviousSecretLifetime) * time.Minute)
+	callbackSecrets, err := s.Database.FetchActiveCallbackSecrets(account.Id)
+	if err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+	if len(callbackSecrets) == 0 {
+		// Accounts which never rotated sign with their secretKey
+		var previousSecret database.CallbackSecret
+		previousSecret.Id = uuid.New().String()
+		previousSecret.AccountId = account.Id
+		previousSecret.Secret = account.SecretKey
+		previousSecret.CreationTime = time.Now()
+		previousSecret.ExpirationTime = sql.NullTime{Time: expirationTime, Valid: true}
+		err = s.Database.SaveCallbackSecret(&previousSecret)
+	} else {
+		err = s.Database.ExpireCallbackSecrets(account.Id, expirationTime)
+	}
+	if err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	// Generate the new secret
+	var callbackSecret database.CallbackSecret
+	callbackSecret.Id = uuid.New().String()
+	callbackSecret.AccountId = account.Id
+	callbackSecret.Secret = uuid.New().String()
+	callbackSecret.CreationTime = time.Now()
+	if err = s.Database.SaveCallbackSecret(&callbackSecret); err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	return c.JSON(callbackSecret)
+}
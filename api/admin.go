@@ -0,0 +1,259 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"pkt-checkout/database"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// startAdmin serves the account management API on a listener of its own,
+// meant to stay unreachable for merchants
+func (s *Server) startAdmin() {
+	app := fiber.New(fiber.Config{
+		AppName:               "pkt-checkout-admin",
+		EnableIPValidation:    true,
+		DisableStartupMessage: true,
+	})
+	app.Use(s.requireDatabase)
+	app.Use(s.audit)
+	app.Use(s.authenticateAdmin)
+
+	// GET requests
+	app.Get("/v1/admin/accounts", s.getAccounts)
+	app.Get("/v1/admin/accounts/:id", s.getAccount)
+	app.Get("/v1/admin/audit", s.getAuditEntries)
+	app.Get("/v1/admin/audit/verify", s.verifyAuditLog)
+
+	// POST requests
+	app.Post("/v1/admin/accounts", s.createAccount)
+	app.Post("/v1/admin/accounts/:id", s.updateAccount)
+	app.Post("/v1/admin/accounts/:id/suspend", s.suspendAccount)
+	app.Post("/v1/admin/accounts/:id/resume", s.resumeAccount)
+	app.Post("/v1/admin/accounts/:id/keys", s.createAccountKey)
+
+	// DELETE requests
+	app.Delete("/v1/admin/accounts/:id", s.deleteAccount)
+
+	log.Info().Msg("Starting HTTP admin API server")
+	if err := app.Listen(fmt.Sprintf("%s:%d", s.AdminHttpAddress, s.AdminHttpPort)); err != nil {
+		log.Fatal().Err(err).Msg("Starting HTTP admin API server failed")
+	}
+}
+
+func (s *Server) authenticateAdmin(c *fiber.Ctx) error {
+	token := c.Request().Header.Peek("X-ADMIN-TOKEN")
+	if subtle.ConstantTimeCompare(token, []byte(s.AdminToken)) != 1 {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", "Provided admin token invalid"))
+	}
+	c.Locals(auditActor, "admin")
+	return c.Next()
+}
+
+func (s *Server) fetchAdminAccount(c *fiber.Ctx) (database.Account, error) {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return database.Account{}, err
+	}
+	c.Locals(auditAccountId, uint32(id))
+	return s.Database.FetchAccountById(uint32(id))
+}
+
+func (s *Server) validateColdWalletUnused(account database.Account) *ApiError {
+	accounts, err := s.Database.FetchAccounts()
+	if err != nil {
+		apiError := craftApiError("processing_error", "Internal processing error")
+		return &apiError
+	}
+	for _, other := range accounts {
+		if other.Id != account.Id && other.ColdWallet == account.ColdWallet {
+			apiError := craftApiError("conflict_error", "Account cold wallet already in use")
+			return &apiError
+		}
+	}
+	return nil
+}
+
+func (s *Server) getAccounts(c *fiber.Ctx) error {
+	accounts, err := s.Database.FetchAccounts()
+	if err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+	if accounts == nil {
+		accounts = []database.Account{}
+	}
+
+	// Secret keys are only revealed on creation
+	for j := range accounts {
+		accounts[j].SecretKey = ""
+	}
+
+	return c.JSON(accounts)
+}
+
+func (s *Server) getAccount(c *fiber.Ctx) error {
+	account, err := s.fetchAdminAccount(c)
+	if err != nil {
+		c.Response().SetStatusCode(404)
+		return c.JSON(craftApiError("processing_error", "Provided accountId matches no account"))
+	}
+
+	account.SecretKey = ""
+	return c.JSON(account)
+}
+
+func (s *Server) createAccount(c *fiber.Ctx) error {
+	// Expected arguments
+	var arguments AccountArguments
+	if err := json.Unmarshal(c.Request().Body(), &arguments); err != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", "Provided request body unexpected"))
+	}
+	if arguments.Merchant == nil || arguments.ColdWallet == nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", "Account merchant and cold wallet are required"))
+	}
+
+	// Build account with the defaults of the accounts table
+	account := database.NewAccount()
+	if apiError := s.applyAccountArguments(&account, &arguments); apiError != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(apiError)
+	}
+	if apiError := s.validateColdWalletUnused(account); apiError != nil {
+		c.Response().SetStatusCode(409)
+		return c.JSON(apiError)
+	}
+
+	// Generate key material, revealed only in this response
+	database.NewAccountKeys(&account)
+	err := s.Database.InUnitOfWork(func(uow database.UnitOfWork) error {
+		if err := uow.SaveAccount(&account); err != nil {
+			return err
+		}
+		return database.SaveAccountKeys(uow, account)
+	})
+	if err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	c.Locals(auditAccountId, account.Id)
+	setAuditTarget(c, strconv.FormatUint(uint64(account.Id), 10))
+	return c.JSON(account)
+}
+
+func (s *Server) updateAccount(c *fiber.Ctx) error {
+	account, err := s.fetchAdminAccount(c)
+	if err != nil {
+		c.Response().SetStatusCode(404)
+		return c.JSON(craftApiError("processing_error", "Provided accountId matches no account"))
+	}
+
+	// Expected arguments, fields left out remain unchanged
+	var arguments AccountArguments
+	if err = json.Unmarshal(c.Request().Body(), &arguments); err != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", "Provided request body unexpected"))
+	}
+	coldWallet := account.ColdWallet
+	if apiError := s.applyAccountArguments(&account, &arguments); apiError != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(apiError)
+	}
+	if account.ColdWallet != coldWallet {
+		if apiError := s.validateColdWalletUnused(account); apiError != nil {
+			c.Response().SetStatusCode(409)
+			return c.JSON(apiError)
+		}
+	}
+
+	if err = s.Database.UpdateAccount(&account); err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	account.SecretKey = ""
+	return c.JSON(account)
+}
+
+func (s *Server) suspendAccount(c *fiber.Ctx) error {
+	return s.updateAccountSuspension(c, true)
+}
+
+func (s *Server) resumeAccount(c *fiber.Ctx) error {
+	return s.updateAccountSuspension(c, false)
+}
+
+func (s *Server) updateAccountSuspension(c *fiber.Ctx, suspended bool) error {
+	account, err := s.fetchAdminAccount(c)
+	if err != nil {
+		c.Response().SetStatusCode(404)
+		return c.JSON(craftApiError("processing_error", "Provided accountId matches no account"))
+	}
+
+	// Suspended accounts are rejected by all merchant endpoints, their
+	// invoices are still watched for payments and call back
+	account.Suspended = suspended
+	if err = s.Database.UpdateAccount(&account); err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	account.SecretKey = ""
+	return c.JSON(account)
+}
+
+func (s *Server) createAccountKey(c *fiber.Ctx) error {
+	account, err := s.fetchAdminAccount(c)
+	if err != nil {
+		c.Response().SetStatusCode(404)
+		return c.JSON(craftApiError("processing_error", "Provided accountId matches no account"))
+	}
+
+	// Generate the key, it is only revealed in this response
+	apiKey, apiError := buildApiKey(account, c.Request().Body())
+	if apiError != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(apiError)
+	}
+	if err = s.Database.SaveApiKey(&apiKey); err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	setAuditTarget(c, apiKey.Id)
+	return c.JSON(craftApiKeyDetails(apiKey))
+}
+
+func (s *Server) deleteAccount(c *fiber.Ctx) error {
+	account, err := s.fetchAdminAccount(c)
+	if err != nil {
+		c.Response().SetStatusCode(404)
+		return c.JSON(craftApiError("processing_error", "Provided accountId matches no account"))
+	}
+
+	// Only suspended accounts without invoices awaiting payment may go
+	err = s.Database.DeleteAccount(&account)
+	if err == database.ErrAccountNotSuspended {
+		c.Response().SetStatusCode(409)
+		return c.JSON(craftApiError("conflict_error", "Account must be suspended before deletion"))
+	}
+	if err == database.ErrAccountHasPendingInvoices {
+		c.Response().SetStatusCode(409)
+		return c.JSON(craftApiError("conflict_error", "Account has invoices awaiting payment"))
+	}
+	if err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	account.SecretKey = ""
+	return c.JSON(account)
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"errors"
+	"net/netip"
+	"pkt-checkout/database"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Locals handlers leave for the audit log
+const (
+	auditActor     = "auditActor"
+	auditAccountId = "auditAccountId"
+	auditTarget    = "auditTarget"
+)
+
+// audit records every mutating call with its actor, target, request IP and
+// outcome once the handler returns
+func (s *Server) audit(c *fiber.Ctx) error {
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+		return c.Next()
+	}
+	err := c.Next()
+
+	// Outcome as sent by the error handler for errors returned
+	outcome := c.Response().StatusCode()
+	if err != nil {
+		outcome = fiber.StatusInternalServerError
+		var fiberError *fiber.Error
+		if errors.As(err, &fiberError) {
+			outcome = fiberError.Code
+		}
+	}
+
+	// Actions are named by route, requests no route matched changed nothing
+	// unless they were rejected before reaching one. Only middlewares are
+	// mounted on the root.
+	action := c.Method() + " " + c.Route().Path
+	if c.Route().Path == "/" {
+		if outcome == fiber.StatusNotFound {
+			return err
+		}
+		action = c.Method() + " " + c.Path()
+	}
+
+	entry := database.AuditEntry{
+		EventTime: time.Now(),
+		Actor:     "anonymous",
+		Action:    action,
+		Target:    c.Path(),
+		Ip:        s.requestIp(c),
+		Outcome:   outcome,
+	}
+	if actor, ok := c.Locals(auditActor).(string); ok {
+		entry.Actor = actor
+	}
+	if accountId, ok := c.Locals(auditAccountId).(uint32); ok {
+		entry.AccountId = accountId
+	}
+	if target, ok := c.Locals(auditTarget).(string); ok {
+		entry.Target = target
+	}
+	// Calls which can't be recorded fail, even though their changes stay
+	if appendErr := s.Database.AppendAuditEntry(&entry); appendErr != nil {
+		log.Error().Err(appendErr).Str("action", entry.Action).Str("target", entry.Target).Int("outcome", entry.Outcome).Msg("Appending audit log entry failed")
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	return err
+}
+
+// setAuditActor records the API key a request authenticated with
+func setAuditActor(c *fiber.Ctx, apiKey database.ApiKey) {
+	c.Locals(auditActor, "apiKey:"+apiKey.Id)
+	c.Locals(auditAccountId, apiKey.AccountId)
+}
+
+// setAuditTarget records the resource a request created, as its path
+func setAuditTarget(c *fiber.Ctx, id string) {
+	c.Locals(auditTarget, c.Path()+"/"+id)
+}
+
+// requestIp is the address of the client, as reported by a trusted proxy
+func (s *Server) requestIp(c *fiber.Ctx) string {
+	remote, ok := netip.AddrFromSlice(c.Context().RemoteIP())
+	if !ok {
+		return c.IP()
+	}
+	remote = remote.Unmap()
+	if !s.trustedProxy(remote) {
+		return remote.String()
+	}
+
+	// nginx appends the address it was connected from, earlier entries are
+	// whatever the client sent
+	header := string(c.Request().Header.Peek(fiber.HeaderXForwardedFor))
+	if len(header) == 0 {
+		return remote.String()
+	}
+	entries := strings.Split(header, ",")
+	client, err := netip.ParseAddr(strings.TrimSpace(entries[len(entries)-1]))
+	if err != nil {
+		return remote.String()
+	}
+	return client.Unmap().String()
+}
+
+func (s *Server) trustedProxy(addr netip.Addr) bool {
+	for _, prefix := range s.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, proxy := range proxies {
+		if addr, err := netip.ParseAddr(proxy); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func (s *Server) getAuditEntries(c *fiber.Ctx) error {
+	// Validate filters
+	var filter database.AuditFilter
+	filter.Actor = c.Query("actor")
+	filter.Action = c.Query("action")
+	accountId := c.QueryInt("accountId", 0)
+	if accountId < 0 {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", "Audit accountId must be positive"))
+	}
+	filter.AccountId = uint32(accountId)
+	for _, bound := range []struct {
+		name string
+		time *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if value := c.Query(bound.name); len(value) > 0 {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.Response().SetStatusCode(400)
+				return c.JSON(craftApiError("processing_error", "Audit since and until must be RFC 3339 times"))
+			}
+			*bound.time = t
+		}
+	}
+
+	// Validate pagination
+	limit := c.QueryInt("limit", 100)
+	offset := c.QueryInt("offset", 0)
+	if limit < 1 || limit > 1000 || offset < 0 {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", "Audit limit must be within 1 to 1000 and offset positive"))
+	}
+
+	entries, err := s.Database.FetchAuditEntries(filter, limit, offset)
+	if err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+	if entries == nil {
+		entries = []database.AuditEntry{}
+	}
+
+	return c.JSON(entries)
+}
+
+func (s *Server) verifyAuditLog(c *fiber.Ctx) error {
+	verification, err := database.VerifyAuditLog(s.Database)
+	if err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	return c.JSON(verification)
+}
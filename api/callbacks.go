@@ -0,0 +1,125 @@
+package api
+
+import (
+	"database/sql"
+	"pkt-checkout/database"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func (s *Server) getCallbacks(c *fiber.Ctx) error {
+	// Fetch account for apiKey
+	account, err := s.authenticateRequest(c, database.ApiKeyScopeAdmin)
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Validate status filter
+	status := database.CallbackStatus(c.Query("status"))
+	if len(status) > 0 && status != database.CallbackStatusCreated && status != database.CallbackStatusFailed && status != database.CallbackStatusDelivered {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", "Callback status must be one of created, failed, delivered"))
+	}
+
+	// Validate pagination
+	limit := c.QueryInt("limit", 50)
+	offset := c.QueryInt("offset", 0)
+	if limit < 1 || limit > 500 || offset < 0 {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", "Callback limit must be within 1 to 500 and offset positive"))
+	}
+
+	// Fetch callbacks of all invoices of the account
+	callbacks, err := s.Database.FetchCallbacksByAccountId(account.Id, status, limit, offset)
+	if err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+	if callbacks == nil {
+		callbacks = []database.Callback{}
+	}
+
+	return c.JSON(callbacks)
+}
+
+func (s *Server) getCallbackAttempts(c *fiber.Ctx) error {
+	// Fetch account for apiKey
+	account, err := s.authenticateRequest(c, database.ApiKeyScopeAdmin)
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Fetch callback for callbackId
+	cb, err := s.fetchAccountCallback(account, c.Params("id"))
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", "Provided callbackId matches no callback"))
+	}
+
+	// Fetch delivery attempts
+	callbackAttempts, err := s.Database.FetchCallbackAttemptsByCallbackId(cb.Id)
+	if err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+	if callbackAttempts == nil {
+		callbackAttempts = []database.CallbackAttempt{}
+	}
+
+	return c.JSON(callbackAttempts)
+}
+
+func (s *Server) redeliverCallback(c *fiber.Ctx) error {
+	// Fetch account for apiKey and validate the signature
+	account, err := s.authenticateSignedRequest(c, database.ApiKeyScopeAdmin)
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Fetch callback for callbackId
+	cb, err := s.fetchAccountCallback(account, c.Params("id"))
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", "Provided callbackId matches no callback"))
+	}
+
+	// Only dead-lettered callbacks may be requeued
+	if cb.Status != database.CallbackStatusFailed {
+		c.Response().SetStatusCode(409)
+		return c.JSON(craftApiError("conflict_error", "Callback must have failed to be redelivered"))
+	}
+
+	if err = s.Callbacks.RequeueCallback(cb); err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	cb, err = s.Database.FetchCallbackById(cb.Id)
+	if err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	return c.JSON(cb)
+}
+
+func (s *Server) fetchAccountCallback(account database.Account, callbackId string) (database.Callback, error) {
+	cb, err := s.Database.FetchCallbackById(callbackId)
+	if err != nil {
+		return cb, err
+	}
+
+	// Callbacks belong to the account owning their invoice
+	invoice, err := s.Database.FetchInvoiceById(cb.InvoiceId)
+	if err != nil {
+		return cb, err
+	}
+	if invoice.AccountId != account.Id {
+		return cb, sql.ErrNoRows
+	}
+
+	return cb, nil
+}
@@ -0,0 +1,30 @@
+package api
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// Seconds clients are asked to wait while the database is unavailable
+const databaseRetryAfter = "30"
+
+// requireDatabase refuses requests while the database is unavailable instead
+// of failing them halfway
+func (s *Server) requireDatabase(c *fiber.Ctx) error {
+	if !s.Database.Healthy() {
+		c.Set(fiber.HeaderRetryAfter, databaseRetryAfter)
+		c.Response().SetStatusCode(503)
+		return c.JSON(craftApiError("processing_error", "Database temporarily unavailable"))
+	}
+	return c.Next()
+}
+
+func (s *Server) getHealth(c *fiber.Ctx) error {
+	health := Health{Status: "ok", Database: s.Database.Healthy()}
+	if !health.Database {
+		health.Status = "degraded"
+		c.Set(fiber.HeaderRetryAfter, databaseRetryAfter)
+		c.Response().SetStatusCode(503)
+	}
+
+	return c.JSON(health)
+}
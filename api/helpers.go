@@ -1,6 +1,27 @@
 package api
 
-import "github.com/gofiber/fiber/v2"
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"pkt-checkout/callback"
+	"pkt-checkout/database"
+	"pkt-checkout/wallet"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
 
 func craftApiError(code string, message string) ApiError {
 	return ApiError{
@@ -9,8 +30,392 @@ func craftApiError(code string, message string) ApiError {
 	}
 }
 
+func craftApiConflictError(code string, message string, invoice database.Invoice) ApiConflictError {
+	return ApiConflictError{
+		ApiError: craftApiError(code, message),
+		Invoice:  invoice,
+	}
+}
+
+func craftApiKeyDetails(apiKey database.ApiKey) ApiKeyDetails {
+	details := ApiKeyDetails{ApiKey: apiKey}
+	if apiKey.ExpirationTime.Valid {
+		details.ExpirationTime = &apiKey.ExpirationTime.Time
+	}
+	if apiKey.LastUsedTime.Valid {
+		details.LastUsedTime = &apiKey.LastUsedTime.Time
+	}
+	if apiKey.RevocationTime.Valid {
+		details.RevocationTime = &apiKey.RevocationTime.Time
+	}
+	return details
+}
+
+// craftWebhookEndpointDetails lists the subscribed events as the array they
+// are accepted as, empty when subscribing to all events
+func craftWebhookEndpointDetails(webhookEndpoint database.WebhookEndpoint) WebhookEndpointDetails {
+	details := WebhookEndpointDetails{WebhookEndpoint: webhookEndpoint, Events: []database.CallbackEvent{}}
+	if len(webhookEndpoint.Events) > 0 {
+		for _, event := range strings.Split(webhookEndpoint.Events, ",") {
+			details.Events = append(details.Events, database.CallbackEvent(event))
+		}
+	}
+	return details
+}
+
 func (s *Server) preflightPublicView(c *fiber.Ctx) error {
 	c.Response().Header.Add("Access-Control-Allow-Origin", s.CorsOrigin)
 	c.Response().Header.Add("Access-Control-Allow-Headers", "X-VIEW-KEY")
 	return nil
 }
+
+func (s *Server) authenticateKey(c *fiber.Ctx, key string, scope database.ApiKeyScope) (database.Account, database.ApiKey, error) {
+	// Resolve the key to its account
+	apiKey, err := s.Database.FetchActiveApiKey(key)
+	if err != nil {
+		return database.Account{}, apiKey, errors.New("Provided apiKey matches no account")
+	}
+	setAuditActor(c, apiKey)
+	if !apiKey.HasScope(scope) {
+		return database.Account{}, apiKey, fmt.Errorf("Provided apiKey lacks the %s scope", scope)
+	}
+	account, err := s.Database.FetchAccountById(apiKey.AccountId)
+	if err != nil {
+		return account, apiKey, errors.New("Provided apiKey matches no account")
+	}
+	if account.Suspended {
+		return database.Account{}, apiKey, errors.New("Provided apiKey belongs to a suspended account")
+	}
+
+	if err := s.Database.TouchApiKey(&apiKey); err != nil {
+		log.Warn().Err(err).Str("apiKey", apiKey.Id).Msg("Recording API key usage failed")
+	}
+
+	return account, apiKey, nil
+}
+
+func (s *Server) authenticateRequest(c *fiber.Ctx, scope database.ApiKeyScope) (database.Account, error) {
+	account, _, err := s.authenticateKey(c, string(c.Request().Header.Peek("X-API-KEY")), scope)
+	return account, err
+}
+
+func (s *Server) authenticateSignedRequest(c *fiber.Ctx, scope database.ApiKeyScope) (database.Account, error) {
+	// Fetch account for apiKey
+	account, apiKey, err := s.authenticateKey(c, string(c.Request().Header.Peek("X-API-KEY")), scope)
+	if err != nil {
+		return account, err
+	}
+
+	// Validate the signature
+	hexSignature, err := hex.DecodeString(string(c.Request().Header.Peek("X-SIGNATURE")))
+	if err != nil {
+		return account, errors.New("Provided signature matches no account")
+	}
+
+	// Generate HMAC of content with the secret of the key, the account's
+	// own keys sign with its secretKey
+	secretKey := account.SecretKey
+	if len(apiKey.SecretKey) > 0 {
+		secretKey = apiKey.SecretKey
+	}
+	h := hmac.New(sha256.New, []byte(secretKey))
+	h.Write(c.Request().Body())
+	if !bytes.Equal(h.Sum(nil), hexSignature) {
+		return account, errors.New("Provided signature matches no account")
+	}
+
+	return account, nil
+}
+
+func (s *Server) validateInvoiceArguments(arguments *InvoiceArguments) *ApiError {
+	var apiError ApiError
+
+	// Validate client ID
+	if len(arguments.ClientId) > 0 {
+		if len(arguments.ClientId) > 36 {
+			apiError = craftApiError("processing_error", "Invoice client ID must be less than 37 chars")
+			return &apiError
+		}
+	}
+
+	// Validate payment amount
+	if arguments.PaymentAmount < 1 {
+		apiError = craftApiError("processing_error", "Invoice payment amount must be greater than 0 µPKT")
+		return &apiError
+	}
+
+	// Validate payment description
+	if len(arguments.PaymentDescription) > 0 {
+		if !regexp.MustCompile("^[A-Za-z0-9 :-]+$").MatchString(arguments.PaymentDescription) {
+			apiError = craftApiError("processing_error", "Invoice payment description must match regex ^[A-Za-z0-9 :-]+$")
+			return &apiError
+		}
+	}
+
+	// Validate payment expiration
+	if arguments.PaymentExpiration > 0 {
+		if arguments.PaymentExpiration < 5 || arguments.PaymentExpiration > 60 {
+			apiError = craftApiError("processing_error", "Invoice payment expiration must be within 5 to 60 minutes")
+			return &apiError
+		}
+	}
+
+	// Validate callback URL
+	if len(arguments.CallbackUrl) > 0 {
+		if apiError := s.validateCallbackUrl(arguments.CallbackUrl); apiError != nil {
+			return apiError
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) buildInvoice(account database.Account, arguments *InvoiceArguments, paymentAddress string) database.Invoice {
+	var invoice database.Invoice
+	invoice.Id = uuid.New().String()
+	invoice.ClientId = arguments.ClientId
+	invoice.AccountId = account.Id
+	invoice.PaymentAmount = arguments.PaymentAmount
+	invoice.PaymentAddress = paymentAddress
+	invoice.PaymentDescription = arguments.PaymentDescription
+	invoice.CallbackUrl = arguments.CallbackUrl
+	invoice.CreationTime = time.Now()
+	if arguments.PaymentExpiration > 0 {
+		invoice.ExpirationTime = time.Now().Add(time.Duration(arguments.PaymentExpiration) * time.Minute)
+	} else {
+		invoice.ExpirationTime = time.Now().Add(time.Duration(s.InvoiceTimeout) * time.Minute)
+	}
+	invoice.Status = database.InvoiceStatusCreated
+	return invoice
+}
+
+func validateCallbackEvents(events []database.CallbackEvent) (string, *ApiError) {
+	var validEvents []string
+	for _, event := range events {
+		eventFound := false
+		for _, knownEvent := range database.CallbackEvents() {
+			if event == knownEvent {
+				eventFound = true
+				break
+			}
+		}
+		if !eventFound {
+			apiError := craftApiError("processing_error", "Callback event must be one of the documented event types")
+			return "", &apiError
+		}
+		validEvents = append(validEvents, string(event))
+	}
+	return strings.Join(validEvents, ","), nil
+}
+
+func validateApiKeyScopes(scopes []database.ApiKeyScope) (string, *ApiError) {
+	var validScopes []string
+	for _, scope := range scopes {
+		scopeFound := false
+		for _, knownScope := range database.ApiKeyScopes() {
+			if scope == knownScope {
+				scopeFound = true
+				break
+			}
+		}
+		if !scopeFound {
+			apiError := craftApiError("processing_error", "API key scope must be one of the documented scopes")
+			return "", &apiError
+		}
+		validScopes = append(validScopes, string(scope))
+	}
+	if len(validScopes) == 0 {
+		apiError := craftApiError("processing_error", "API key must be granted at least one scope")
+		return "", &apiError
+	}
+	return strings.Join(validScopes, ","), nil
+}
+
+func buildApiKey(account database.Account, body []byte) (database.ApiKey, *ApiError) {
+	var apiKey database.ApiKey
+	var apiError ApiError
+
+	// Expected arguments
+	var arguments struct {
+		Label    string                 `json:"label"`
+		Scopes   []database.ApiKeyScope `json:"scopes"`
+		Lifetime uint32                 `json:"lifetime"`
+	}
+	if err := json.Unmarshal(body, &arguments); err != nil {
+		apiError = craftApiError("processing_error", "Provided request body unexpected")
+		return apiKey, &apiError
+	}
+
+	// Validate label
+	if len(arguments.Label) > 64 {
+		apiError = craftApiError("processing_error", "API key label must be less than 65 chars")
+		return apiKey, &apiError
+	}
+
+	// Validate scopes
+	scopes, scopeError := validateApiKeyScopes(arguments.Scopes)
+	if scopeError != nil {
+		return apiKey, scopeError
+	}
+
+	// Validate lifetime, keys without one never expire
+	if arguments.Lifetime > 525600 {
+		apiError = craftApiError("processing_error", "API key lifetime must be within 0 to 525600 minutes")
+		return apiKey, &apiError
+	}
+
+	apiKey.Id = uuid.New().String()
+	apiKey.AccountId = account.Id
+	apiKey.Label = arguments.Label
+	apiKey.Key = uuid.New().String()
+	apiKey.Scopes = scopes
+	apiKey.SecretKey = uuid.New().String()
+	apiKey.CreationTime = time.Now()
+	if arguments.Lifetime > 0 {
+		apiKey.ExpirationTime = sql.NullTime{Time: apiKey.CreationTime.Add(time.Duration(arguments.Lifetime) * time.Minute), Valid: true}
+	}
+	return apiKey, nil
+}
+
+func (s *Server) applyAccountArguments(account *database.Account, arguments *AccountArguments) *ApiError {
+	var apiError ApiError
+
+	// Validate merchant
+	if arguments.Merchant != nil {
+		if len(*arguments.Merchant) < 1 || len(*arguments.Merchant) > 32 {
+			apiError = craftApiError("processing_error", "Account merchant must be 1 to 32 chars")
+			return &apiError
+		}
+		account.Merchant = *arguments.Merchant
+	}
+
+	// Validate cold wallet
+	if arguments.ColdWallet != nil {
+		if !wallet.IsPktAddress(*arguments.ColdWallet) {
+			apiError = craftApiError("processing_error", "Account cold wallet must be a valid PKT address")
+			return &apiError
+		}
+		account.ColdWallet = *arguments.ColdWallet
+	}
+
+	if arguments.UniqueClientId != nil {
+		account.UniqueClientId = *arguments.UniqueClientId
+	}
+
+	// Validate invoice limits
+	if arguments.InvoiceExtensions != nil {
+		if *arguments.InvoiceExtensions < 0 || *arguments.InvoiceExtensions > 100 {
+			apiError = craftApiError("processing_error", "Account invoice extensions must be within 0 to 100")
+			return &apiError
+		}
+		account.InvoiceExtensions = *arguments.InvoiceExtensions
+	}
+	if arguments.InvoiceMaxLifetime != nil {
+		if *arguments.InvoiceMaxLifetime < 5 || *arguments.InvoiceMaxLifetime > 10080 {
+			apiError = craftApiError("processing_error", "Account invoice max lifetime must be within 5 to 10080 minutes")
+			return &apiError
+		}
+		account.InvoiceMaxLifetime = *arguments.InvoiceMaxLifetime
+	}
+
+	// Validate events, an empty list subscribes to all events
+	if arguments.CallbackEvents != nil {
+		events, eventsError := validateCallbackEvents(*arguments.CallbackEvents)
+		if eventsError != nil {
+			return eventsError
+		}
+		account.CallbackEvents = events
+	}
+
+	// Validate the resulting retry policy, an empty object reverts to the global policy
+	if arguments.CallbackRetryPolicy != nil {
+		compactOverride := bytes.Buffer{}
+		if err := json.Compact(&compactOverride, *arguments.CallbackRetryPolicy); err != nil {
+			apiError = craftApiError("processing_error", "Callback retry policy invalid")
+			return &apiError
+		}
+		if _, err := callback.NewRetryPolicy().WithOverride(compactOverride.String()); err != nil {
+			apiError = craftApiError("processing_error", fmt.Sprintf("Callback retry policy invalid: %s", err.Error()))
+			return &apiError
+		}
+		account.CallbackRetryPolicy = compactOverride.String()
+		if account.CallbackRetryPolicy == "{}" {
+			account.CallbackRetryPolicy = ""
+		}
+	}
+
+	// Validate acknowledgement, an empty one reverts to the global setting
+	if arguments.CallbackAcknowledgement != nil {
+		if len(*arguments.CallbackAcknowledgement) > 0 {
+			if err := arguments.CallbackAcknowledgement.Validate(); err != nil {
+				apiError = craftApiError("processing_error", fmt.Sprintf("Callback acknowledgement invalid: %s", err.Error()))
+				return &apiError
+			}
+		}
+		account.CallbackAcknowledgement = string(*arguments.CallbackAcknowledgement)
+	}
+
+	return nil
+}
+
+func (s *Server) validateCallbackUrl(callbackUrl string) *ApiError {
+	var apiError ApiError
+
+	if len(callbackUrl) > 255 {
+		apiError = craftApiError("processing_error", "Callback URL must be less than 256 chars")
+		return &apiError
+	}
+	if uri, err := url.ParseRequestURI(callbackUrl); err != nil || uri.Scheme != "https" {
+		apiError = craftApiError("processing_error", "Callback URL must be valid URL")
+		return &apiError
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Callbacks.Guard.ValidateUrl(ctx, callbackUrl); err != nil {
+		apiError = craftApiError("processing_error", "Callback URL must resolve to public addresses")
+		return &apiError
+	}
+
+	return nil
+}
+
+func (s *Server) validateWebhookUrl(webhookUrl string) *ApiError {
+	var apiError ApiError
+
+	if len(webhookUrl) > 255 {
+		apiError = craftApiError("processing_error", "Webhook URL must be less than 256 chars")
+		return &apiError
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Callbacks.ValidateDestination(ctx, webhookUrl); err != nil {
+		apiError = craftApiError("processing_error", "Webhook URL is not deliverable: "+err.Error())
+		return &apiError
+	}
+
+	return nil
+}
+
+func (s *Server) saveInvoice(account database.Account, invoice *database.Invoice) error {
+	return s.Database.InUnitOfWork(func(uow database.UnitOfWork) error {
+		// Client IDs unique per account are checked with the account locked,
+		// concurrent creations would both pass otherwise
+		if len(invoice.ClientId) > 0 && account.UniqueClientId {
+			if err := uow.LockAccount(account.Id); err != nil {
+				return err
+			}
+			_, err := uow.FetchInvoiceByClientId(account.Id, invoice.ClientId)
+			if err == nil {
+				return database.ErrInvoiceClientIdInUse
+			}
+			if err != sql.ErrNoRows {
+				return err
+			}
+		}
+
+		if err := uow.SaveInvoice(invoice); err != nil {
+			return err
+		}
+		return callback.EnqueueCallback(uow, *invoice, database.CallbackEventInvoiceCreated)
+	})
+}
@@ -1,44 +1,127 @@
 package api
 
 import (
-	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
+	"database/sql"
 	"encoding/json"
-	"net/url"
+	"errors"
+	"fmt"
+	"pkt-checkout/callback"
 	"pkt-checkout/database"
-	"regexp"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 )
 
+var (
+	errInvoiceExtensionsExhausted = errors.New("invoice extensions exhausted")
+	errInvoiceLifetimeExceeded    = errors.New("invoice lifetime exceeded")
+)
+
 func (s *Server) getInvoiceById(c *fiber.Ctx) error {
 	// Fetch account for apiKey
-	apiKey := string(c.Request().Header.Peek("X-API-KEY"))
-	account, err := database.FetchAccountByApiKey(apiKey)
+	account, err := s.authenticateRequest(c, database.ApiKeyScopeInvoicesRead)
 	if err != nil {
 		c.Response().SetStatusCode(403)
-		return c.JSON(craftApiError("authentication_error", "Provided apiKey matches no account"))
+		return c.JSON(craftApiError("authentication_error", err.Error()))
 	}
 
 	// Fetch invoice for invoiceId
 	invoiceId := c.Params("id")
-	invoice, err := database.FetchInvoiceById(invoiceId)
+	invoice, err := s.Database.FetchInvoiceById(invoiceId)
 	if err != nil || invoice.AccountId != account.Id {
 		c.Response().SetStatusCode(403)
 		return c.JSON(craftApiError("authentication_error", "Provided invoiceId matches no invoice"))
 	}
 
+	// Bare invoice unless an expanded representation was requested
+	expand := c.Query("expand")
+	if len(expand) == 0 {
+		return c.JSON(invoice)
+	}
+
+	invoiceDetails := InvoiceDetails{Invoice: invoice}
+	for _, field := range strings.Split(expand, ",") {
+		switch strings.TrimSpace(field) {
+		case "transactions":
+			// Fetch transactions made towards the invoice
+			walletTransactions, err := s.Database.FetchWalletTransactionsByInvoiceId(invoice.Id)
+			if err != nil {
+				c.Response().SetStatusCode(500)
+				return c.JSON(craftApiError("processing_error", "Internal processing error"))
+			}
+			if walletTransactions == nil {
+				walletTransactions = []database.WalletTransaction{}
+			}
+			invoiceDetails.Transactions = &walletTransactions
+
+			// Fetch the sum of all payments made towards the invoice
+			paymentAmountSum, err := s.Database.FetchPaymentAmountSumForInvoiceId(invoice.Id)
+			if err != nil {
+				c.Response().SetStatusCode(500)
+				return c.JSON(craftApiError("processing_error", "Internal processing error"))
+			}
+			var paymentAmountOutstanding uint64
+			if paymentAmountSum < invoice.PaymentAmount {
+				paymentAmountOutstanding = invoice.PaymentAmount - paymentAmountSum
+			}
+			invoiceDetails.PaymentAmountReceived = &paymentAmountSum
+			invoiceDetails.PaymentAmountOutstanding = &paymentAmountOutstanding
+		case "callbacks":
+			// Fetch callbacks requested for the invoice
+			callbacks, err := s.Database.FetchCallbacksByInvoiceId(invoice.Id)
+			if err != nil {
+				c.Response().SetStatusCode(500)
+				return c.JSON(craftApiError("processing_error", "Internal processing error"))
+			}
+			if callbacks == nil {
+				callbacks = []database.Callback{}
+			}
+			invoiceDetails.Callbacks = &callbacks
+		case "history":
+			// Fetch extensions and re-quotes of the invoice
+			invoiceHistory, err := s.Database.FetchInvoiceHistoryByInvoiceId(invoice.Id)
+			if err != nil {
+				c.Response().SetStatusCode(500)
+				return c.JSON(craftApiError("processing_error", "Internal processing error"))
+			}
+			if invoiceHistory == nil {
+				invoiceHistory = []database.InvoiceHistory{}
+			}
+			invoiceDetails.History = &invoiceHistory
+		default:
+			c.Response().SetStatusCode(400)
+			return c.JSON(craftApiError("processing_error", "Invoice expand must be a list of transactions, callbacks, history"))
+		}
+	}
+
+	return c.JSON(invoiceDetails)
+}
+
+func (s *Server) getInvoiceByClientId(c *fiber.Ctx) error {
+	// Fetch account for apiKey
+	account, err := s.authenticateRequest(c, database.ApiKeyScopeInvoicesRead)
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Fetch most recent invoice for clientId
+	clientId := c.Params("clientId")
+	invoice, err := s.Database.FetchInvoiceByClientId(account.Id, clientId)
+	if err != nil {
+		c.Response().SetStatusCode(404)
+		return c.JSON(craftApiError("processing_error", "Provided clientId matches no invoice"))
+	}
+
 	return c.JSON(invoice)
 }
 
 func (s *Server) getInvoicePublicById(c *fiber.Ctx) error {
 	// Fetch account for viewKey
 	viewKey := string(c.Request().Header.Peek("X-VIEW-KEY"))
-	account, err := database.FetchAccountByViewKey(viewKey)
+	account, _, err := s.authenticateKey(c, viewKey, database.ApiKeyScopeInvoicesView)
 	if err != nil {
 		c.Response().SetStatusCode(403)
 		return c.JSON(craftApiError("authentication_error", "Provided viewKey matches no account"))
@@ -46,7 +129,7 @@ func (s *Server) getInvoicePublicById(c *fiber.Ctx) error {
 
 	// Fetch invoice for invoiceId
 	invoiceId := c.Params("id")
-	invoice, err := database.FetchInvoiceById(invoiceId)
+	invoice, err := s.Database.FetchInvoiceById(invoiceId)
 	if err != nil || invoice.AccountId != account.Id {
 		c.Response().SetStatusCode(403)
 		return c.JSON(craftApiError("authentication_error", "Provided invoiceId matches no invoice"))
@@ -76,48 +159,202 @@ func (s *Server) getInvoicePublicById(c *fiber.Ctx) error {
 }
 
 func (s *Server) createInvoice(c *fiber.Ctx) error {
-	// Fetch account for apiKey
-	apiKey := string(c.Request().Header.Peek("X-API-KEY"))
-	account, err := database.FetchAccountByApiKey(apiKey)
+	// Fetch account for apiKey and validate the signature
+	account, err := s.authenticateSignedRequest(c, database.ApiKeyScopeInvoicesCreate)
 	if err != nil {
 		c.Response().SetStatusCode(403)
-		return c.JSON(craftApiError("authentication_error", "Provided apiKey matches no account"))
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Expected arguments
+	var arguments InvoiceArguments
+	if err = json.Unmarshal(c.Request().Body(), &arguments); err != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", "Provided request body unexpected"))
+	}
+
+	// Validate arguments
+	if apiError := s.validateInvoiceArguments(&arguments); apiError != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(apiError)
+	}
+
+	// Enforce client ID uniqueness, early to spare a payment address
+	if len(arguments.ClientId) > 0 && account.UniqueClientId {
+		invoice, err := s.Database.FetchInvoiceByClientId(account.Id, arguments.ClientId)
+		if err == nil {
+			c.Response().SetStatusCode(409)
+			return c.JSON(craftApiConflictError("conflict_error", "Invoice client ID already in use", invoice))
+		}
+		if err != sql.ErrNoRows {
+			c.Response().SetStatusCode(500)
+			return c.JSON(craftApiError("processing_error", "Internal processing error"))
+		}
+	}
+
+	// Fetch payment address
+	paymentAddress, err := s.Database.FetchLRUWalletAddress()
+	if err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	// Build invoice and notify the merchant atomically
+	invoice := s.buildInvoice(account, &arguments, paymentAddress)
+	if err = s.saveInvoice(account, &invoice); err != nil {
+		s.Database.ReleaseLRUWalletAddress(paymentAddress)
+
+		// Concurrent creations may have taken the client ID in the meantime
+		if err == database.ErrInvoiceClientIdInUse {
+			if invoice, err := s.Database.FetchInvoiceByClientId(account.Id, arguments.ClientId); err == nil {
+				c.Response().SetStatusCode(409)
+				return c.JSON(craftApiConflictError("conflict_error", "Invoice client ID already in use", invoice))
+			}
+		}
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
 	}
 
-	// Validate the signature
-	hexSignature, err := hex.DecodeString(string(c.Request().Header.Peek("X-SIGNATURE")))
+	setAuditTarget(c, invoice.Id)
+	return c.JSON(invoice)
+}
+
+func (s *Server) createInvoiceBatch(c *fiber.Ctx) error {
+	// Fetch account for apiKey and validate the signature
+	account, err := s.authenticateSignedRequest(c, database.ApiKeyScopeInvoicesCreate)
 	if err != nil {
 		c.Response().SetStatusCode(403)
-		return c.JSON(craftApiError("authentication_error", "Provided signature matches no account"))
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Expected arguments
+	var batchArguments []InvoiceArguments
+	if err = json.Unmarshal(c.Request().Body(), &batchArguments); err != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", "Provided request body unexpected"))
+	}
+
+	// Validate batch size
+	if len(batchArguments) < 1 || len(batchArguments) > s.InvoiceBatchLimit {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", fmt.Sprintf("Invoice batch must contain 1 to %d invoices", s.InvoiceBatchLimit)))
+	}
+
+	// Validate every invoice of the batch
+	results := make([]InvoiceBatchResult, len(batchArguments))
+	batchClientIds := make(map[string]bool)
+	var validIndexes []int
+	for j := range batchArguments {
+		arguments := &batchArguments[j]
+		if apiError := s.validateInvoiceArguments(arguments); apiError != nil {
+			results[j].Error = apiError
+			continue
+		}
+
+		// Enforce client ID uniqueness, including within the batch itself and
+		// early to spare payment addresses
+		if len(arguments.ClientId) > 0 && account.UniqueClientId {
+			if batchClientIds[arguments.ClientId] {
+				apiError := craftApiError("conflict_error", "Invoice client ID already in use within batch")
+				results[j].Error = &apiError
+				continue
+			}
+			invoice, err := s.Database.FetchInvoiceByClientId(account.Id, arguments.ClientId)
+			if err == nil {
+				apiError := craftApiError("conflict_error", "Invoice client ID already in use")
+				results[j].Error = &apiError
+				results[j].Invoice = &invoice
+				continue
+			}
+			if err != sql.ErrNoRows {
+				apiError := craftApiError("processing_error", "Internal processing error")
+				results[j].Error = &apiError
+				continue
+			}
+			batchClientIds[arguments.ClientId] = true
+		}
+
+		validIndexes = append(validIndexes, j)
+	}
+
+	// Fetch payment addresses for the whole batch at once
+	if len(validIndexes) > 0 {
+		paymentAddresses, err := s.Database.FetchLRUWalletAddresses(len(validIndexes))
+		if err == database.ErrInsufficientWalletAddresses {
+			c.Response().SetStatusCode(503)
+			return c.JSON(craftApiError("processing_error", "Insufficient payment addresses available for invoice batch"))
+		}
+		if err != nil {
+			c.Response().SetStatusCode(500)
+			return c.JSON(craftApiError("processing_error", "Internal processing error"))
+		}
+
+		// Build invoices
+		for k, j := range validIndexes {
+			invoice := s.buildInvoice(account, &batchArguments[j], paymentAddresses[k])
+			if err = s.saveInvoice(account, &invoice); err != nil {
+				s.Database.ReleaseLRUWalletAddress(paymentAddresses[k])
+				apiError := craftApiError("processing_error", "Internal processing error")
+				if err == database.ErrInvoiceClientIdInUse {
+					apiError = craftApiError("conflict_error", "Invoice client ID already in use")
+					if existing, err := s.Database.FetchInvoiceByClientId(account.Id, invoice.ClientId); err == nil {
+						results[j].Invoice = &existing
+					}
+				}
+				results[j].Error = &apiError
+				continue
+			}
+			results[j].Invoice = &invoice
+		}
 	}
 
-	// Generate HMAC of content
-	h := hmac.New(sha256.New, []byte(account.SecretKey))
-	h.Write(c.Request().Body())
-	if !bytes.Equal(h.Sum(nil), hexSignature) {
+	return c.JSON(results)
+}
+
+func (s *Server) extendInvoice(c *fiber.Ctx) error {
+	// Fetch account for apiKey and validate the signature
+	account, err := s.authenticateSignedRequest(c, database.ApiKeyScopeInvoicesCreate)
+	if err != nil {
 		c.Response().SetStatusCode(403)
-		return c.JSON(craftApiError("authentication_error", "Provided signature matches no account"))
+		return c.JSON(craftApiError("authentication_error", err.Error()))
 	}
 
 	// Expected arguments
 	var arguments struct {
-		ClientId           string `json:"clientId"`
-		PaymentAmount      uint64 `json:"paymentAmount"`
-		PaymentDescription string `json:"paymentDescription"`
-		PaymentExpiration  uint16 `json:"paymentExpiration"`
-		CallbackUrl        string `json:"callbackUrl"`
+		PaymentExpiration uint16 `json:"paymentExpiration"`
 	}
 	if err = json.Unmarshal(c.Request().Body(), &arguments); err != nil {
 		c.Response().SetStatusCode(400)
 		return c.JSON(craftApiError("processing_error", "Provided request body unexpected"))
 	}
 
-	// Validate client ID
-	if len(arguments.ClientId) > 0 {
-		if len(arguments.ClientId) > 36 {
-			c.Response().SetStatusCode(400)
-			return c.JSON(craftApiError("processing_error", "Invoice client ID must be less than 37 chars"))
-		}
+	// Validate payment expiration
+	if arguments.PaymentExpiration < 5 || arguments.PaymentExpiration > 60 {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", "Invoice payment expiration must be within 5 to 60 minutes"))
+	}
+
+	return s.updateInvoiceQuote(c, account, database.InvoiceHistoryActionExtended, func(invoice *database.Invoice) {
+		invoice.ExpirationTime = invoice.ExpirationTime.Add(time.Duration(arguments.PaymentExpiration) * time.Minute)
+	})
+}
+
+func (s *Server) requoteInvoice(c *fiber.Ctx) error {
+	// Fetch account for apiKey and validate the signature
+	account, err := s.authenticateSignedRequest(c, database.ApiKeyScopeInvoicesCreate)
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Expected arguments
+	var arguments struct {
+		PaymentAmount     uint64 `json:"paymentAmount"`
+		PaymentExpiration uint16 `json:"paymentExpiration"`
+	}
+	if err = json.Unmarshal(c.Request().Body(), &arguments); err != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", "Provided request body unexpected"))
 	}
 
 	// Validate payment amount
@@ -126,14 +363,6 @@ func (s *Server) createInvoice(c *fiber.Ctx) error {
 		return c.JSON(craftApiError("processing_error", "Invoice payment amount must be greater than 0 µPKT"))
 	}
 
-	// Validate payment description
-	if len(arguments.PaymentDescription) > 0 {
-		if !regexp.MustCompile("^[A-Za-z0-9 :-]+$").MatchString(arguments.PaymentDescription) {
-			c.Response().SetStatusCode(400)
-			return c.JSON(craftApiError("processing_error", "Invoice payment description must match regex ^[A-Za-z0-9 :-]+$"))
-		}
-	}
-
 	// Validate payment expiration
 	if arguments.PaymentExpiration > 0 {
 		if arguments.PaymentExpiration < 5 || arguments.PaymentExpiration > 60 {
@@ -142,39 +371,83 @@ func (s *Server) createInvoice(c *fiber.Ctx) error {
 		}
 	}
 
-	// Validate callback URL
-	if len(arguments.CallbackUrl) > 0 {
-		if uri, err := url.ParseRequestURI(arguments.CallbackUrl); err != nil || uri.Scheme != "https" {
-			c.Response().SetStatusCode(400)
-			return c.JSON(craftApiError("processing_error", "Invoice callback URL must be valid URL"))
+	return s.updateInvoiceQuote(c, account, database.InvoiceHistoryActionRequoted, func(invoice *database.Invoice) {
+		invoice.PaymentAmount = arguments.PaymentAmount
+		if arguments.PaymentExpiration > 0 {
+			invoice.ExpirationTime = time.Now().Add(time.Duration(arguments.PaymentExpiration) * time.Minute)
+		} else {
+			invoice.ExpirationTime = time.Now().Add(time.Duration(s.InvoiceTimeout) * time.Minute)
 		}
-	}
+	})
+}
 
-	// Fetch payment address
-	paymentAddress, err := database.FetchLRUWalletAddress()
-	if err != nil {
-		c.Response().SetStatusCode(500)
-		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+func (s *Server) updateInvoiceQuote(c *fiber.Ctx, account database.Account, action database.InvoiceHistoryAction, requote func(invoice *database.Invoice)) error {
+	// Fetch invoice for invoiceId
+	invoiceId := c.Params("id")
+	invoice, err := s.Database.FetchInvoiceById(invoiceId)
+	if err != nil || invoice.AccountId != account.Id {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", "Provided invoiceId matches no invoice"))
 	}
 
-	// Build invoice
-	var invoice database.Invoice
-	invoice.Id = uuid.New().String()
-	invoice.ClientId = arguments.ClientId
-	invoice.AccountId = account.Id
-	invoice.PaymentAmount = arguments.PaymentAmount
-	invoice.PaymentAddress = paymentAddress
-	invoice.PaymentDescription = arguments.PaymentDescription
-	invoice.CallbackUrl = arguments.CallbackUrl
-	invoice.CreationTime = time.Now()
-	if arguments.PaymentExpiration > 0 {
-		invoice.ExpirationTime = time.Now().Add(time.Duration(arguments.PaymentExpiration) * time.Minute)
-	} else {
-		invoice.ExpirationTime = time.Now().Add(time.Duration(s.InvoiceTimeout) * time.Minute)
+	// Persist the new quote, record it in the invoice history and notify the
+	// merchant atomically. Limits are checked with the invoice locked,
+	// concurrent calls would all pass them otherwise.
+	event := database.CallbackEventInvoiceExtended
+	if action == database.InvoiceHistoryActionRequoted {
+		event = database.CallbackEventInvoiceRequoted
 	}
-	invoice.Status = database.InvoiceStatusCreated
+	err = s.Database.InUnitOfWork(func(uow database.UnitOfWork) error {
+		var err error
+		if invoice, err = uow.LockInvoice(invoiceId); err != nil {
+			return err
+		}
 
-	if err = invoice.Save(); err != nil {
+		// Only invoices still awaiting payment may be re-quoted
+		if (invoice.Status != database.InvoiceStatusCreated && invoice.Status != database.InvoiceStatusPending) || invoice.ExpirationTime.Before(time.Now()) {
+			return database.ErrInvoiceNotPending
+		}
+
+		// Enforce account limits
+		invoiceHistory, err := uow.FetchInvoiceHistoryByInvoiceId(invoice.Id)
+		if err != nil {
+			return err
+		}
+		if len(invoiceHistory) >= account.InvoiceExtensions {
+			return errInvoiceExtensionsExhausted
+		}
+		requote(&invoice)
+		if invoice.ExpirationTime.After(invoice.CreationTime.Add(time.Duration(account.InvoiceMaxLifetime) * time.Minute)) {
+			return errInvoiceLifetimeExceeded
+		}
+
+		if err := uow.UpdateInvoiceQuote(&invoice); err != nil {
+			return err
+		}
+
+		var entry database.InvoiceHistory
+		entry.Id = uuid.New().String()
+		entry.InvoiceId = invoice.Id
+		entry.Action = action
+		entry.PaymentAmount = invoice.PaymentAmount
+		entry.ExpirationTime = invoice.ExpirationTime
+		entry.EventTime = time.Now()
+		if err := uow.SaveInvoiceHistory(&entry); err != nil {
+			return err
+		}
+
+		return callback.EnqueueCallback(uow, invoice, event)
+	})
+	if err == database.ErrInvoiceNotPending {
+		c.Response().SetStatusCode(409)
+		return c.JSON(craftApiError("conflict_error", "Invoice is no longer awaiting payment"))
+	} else if err == errInvoiceExtensionsExhausted {
+		c.Response().SetStatusCode(409)
+		return c.JSON(craftApiError("conflict_error", fmt.Sprintf("Invoice may be extended or re-quoted at most %d times", account.InvoiceExtensions)))
+	} else if err == errInvoiceLifetimeExceeded {
+		c.Response().SetStatusCode(409)
+		return c.JSON(craftApiError("conflict_error", fmt.Sprintf("Invoice payment expiration must be within %d minutes of creation", account.InvoiceMaxLifetime)))
+	} else if err != nil {
 		c.Response().SetStatusCode(500)
 		return c.JSON(craftApiError("processing_error", "Internal processing error"))
 	}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"pkt-checkout/database"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func (s *Server) getApiKeys(c *fiber.Ctx) error {
+	// Fetch account for apiKey
+	account, err := s.authenticateRequest(c, database.ApiKeyScopeAdmin)
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Fetch keys of the account, including revoked and expired ones
+	apiKeys, err := s.Database.FetchApiKeysByAccountId(account.Id)
+	if err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	details := []ApiKeyDetails{}
+	for _, apiKey := range apiKeys {
+		details = append(details, craftApiKeyDetails(apiKey))
+	}
+
+	return c.JSON(details)
+}
+
+func (s *Server) createApiKey(c *fiber.Ctx) error {
+	// Fetch account for apiKey and validate the signature
+	account, err := s.authenticateSignedRequest(c, database.ApiKeyScopeAdmin)
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Generate the key, it is only revealed in this response
+	apiKey, apiError := buildApiKey(account, c.Request().Body())
+	if apiError != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(apiError)
+	}
+	if err = s.Database.SaveApiKey(&apiKey); err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	setAuditTarget(c, apiKey.Id)
+	return c.JSON(craftApiKeyDetails(apiKey))
+}
+
+func (s *Server) revokeApiKey(c *fiber.Ctx) error {
+	// Fetch account for apiKey and validate the signature
+	account, err := s.authenticateSignedRequest(c, database.ApiKeyScopeAdmin)
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Fetch key for keyId
+	apiKey, err := s.Database.FetchApiKeyById(c.Params("id"))
+	if err != nil || apiKey.AccountId != account.Id {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", "Provided keyId matches no key"))
+	}
+
+	// Revoked keys are rejected from the next request on
+	if !apiKey.RevocationTime.Valid {
+		if err = s.Database.RevokeApiKey(&apiKey); err != nil {
+			c.Response().SetStatusCode(500)
+			return c.JSON(craftApiError("processing_error", "Internal processing error"))
+		}
+	}
+
+	return c.JSON(craftApiKeyDetails(apiKey))
+}
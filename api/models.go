@@ -1,6 +1,68 @@
 package api
 
+import (
+	"encoding/json"
+	"pkt-checkout/callback"
+	"pkt-checkout/database"
+	"time"
+)
+
 type ApiError struct {
 	Code    string `json:"code"`
 	Message string `json:"message"`
 }
+
+type ApiConflictError struct {
+	ApiError
+	Invoice database.Invoice `json:"invoice"`
+}
+
+type InvoiceDetails struct {
+	database.Invoice
+	PaymentAmountReceived    *uint64                       `json:"paymentAmountReceived,omitempty"`
+	PaymentAmountOutstanding *uint64                       `json:"paymentAmountOutstanding,omitempty"`
+	Transactions             *[]database.WalletTransaction `json:"transactions,omitempty"`
+	Callbacks                *[]database.Callback          `json:"callbacks,omitempty"`
+	History                  *[]database.InvoiceHistory    `json:"history,omitempty"`
+}
+
+type InvoiceArguments struct {
+	ClientId           string `json:"clientId"`
+	PaymentAmount      uint64 `json:"paymentAmount"`
+	PaymentDescription string `json:"paymentDescription"`
+	PaymentExpiration  uint16 `json:"paymentExpiration"`
+	CallbackUrl        string `json:"callbackUrl"`
+}
+
+type InvoiceBatchResult struct {
+	Invoice *database.Invoice `json:"invoice,omitempty"`
+	Error   *ApiError         `json:"error,omitempty"`
+}
+
+type ApiKeyDetails struct {
+	database.ApiKey
+	ExpirationTime *time.Time `json:"expirationTime,omitempty"`
+	LastUsedTime   *time.Time `json:"lastUsedTime,omitempty"`
+	RevocationTime *time.Time `json:"revocationTime,omitempty"`
+}
+
+type WebhookEndpointDetails struct {
+	database.WebhookEndpoint
+	Events []database.CallbackEvent `json:"events"`
+}
+
+type AccountArguments struct {
+	Merchant                *string                   `json:"merchant"`
+	ColdWallet              *string                   `json:"coldWallet"`
+	UniqueClientId          *bool                     `json:"uniqueClientId"`
+	InvoiceExtensions       *int                      `json:"invoiceExtensions"`
+	InvoiceMaxLifetime      *int                      `json:"invoiceMaxLifetime"`
+	CallbackEvents          *[]database.CallbackEvent `json:"callbackEvents"`
+	CallbackRetryPolicy     *json.RawMessage          `json:"callbackRetryPolicy"`
+	CallbackAcknowledgement *callback.Acknowledgement `json:"callbackAcknowledgement"`
+}
+
+type Health struct {
+	Status   string `json:"status"`
+	Database bool   `json:"database"`
+}
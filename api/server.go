@@ -2,6 +2,9 @@ package api
 
 import (
 	"fmt"
+	"net/netip"
+	"pkt-checkout/callback"
+	"pkt-checkout/database"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/rs/zerolog/log"
@@ -9,28 +12,63 @@ import (
 )
 
 type Server struct {
-	HttpAddress    string
-	HttpPort       uint16
-	CorsOrigin     string
-	InvoiceTimeout int
+	Database          database.Store
+	HttpAddress       string
+	HttpPort          uint16
+	CorsOrigin        string
+	InvoiceTimeout    int
+	InvoiceBatchLimit int
+	AdminHttpAddress  string
+	AdminHttpPort     uint16
+	AdminToken        string
+	TrustedProxies    []netip.Prefix
+	Callbacks         *callback.Server
 }
 
-func NewServer() *Server {
+func NewServer(store database.Store, callbackServer *callback.Server) *Server {
 	server := Server{
-		HttpAddress:    viper.GetString("api-http-address"),
-		HttpPort:       viper.GetUint16("api-http-port"),
-		CorsOrigin:     "",
-		InvoiceTimeout: 15,
+		Database:          store,
+		HttpAddress:       viper.GetString("api-http-address"),
+		HttpPort:          viper.GetUint16("api-http-port"),
+		CorsOrigin:        "",
+		InvoiceTimeout:    15,
+		InvoiceBatchLimit: 100,
+		AdminHttpAddress:  "127.0.0.1",
+		AdminHttpPort:     5001,
+		AdminToken:        viper.GetString("admin-token"),
+		Callbacks:         callbackServer,
 	}
 
 	if viper.IsSet("api-invoice-timeout") {
 		server.InvoiceTimeout = viper.GetInt("api-invoice-timeout")
 	}
 
+	if viper.IsSet("api-invoice-batch-limit") {
+		server.InvoiceBatchLimit = viper.GetInt("api-invoice-batch-limit")
+	}
+
+	if viper.IsSet("admin-http-address") {
+		server.AdminHttpAddress = viper.GetString("admin-http-address")
+	}
+
+	if viper.IsSet("admin-http-port") {
+		server.AdminHttpPort = viper.GetUint16("admin-http-port")
+	}
+
 	if viper.IsSet("api-cors-origin") {
 		server.CorsOrigin = viper.GetString("api-cors-origin")
 	}
 
+	// Only the nginx in front of the backend reports client addresses
+	trustedProxies := []string{"127.0.0.1", "::1"}
+	if viper.IsSet("api-trusted-proxies") {
+		trustedProxies = viper.GetStringSlice("api-trusted-proxies")
+	}
+	var err error
+	if server.TrustedProxies, err = parseTrustedProxies(trustedProxies); err != nil {
+		log.Fatal().Err(err).Msg("Interpreting api-trusted-proxies failed")
+	}
+
 	return &server
 }
 
@@ -41,13 +79,47 @@ func (s *Server) Start() {
 		DisableStartupMessage: true,
 	})
 
+	// Served while the database is unavailable, all other requests are refused
+	app.Get("/v1/health", s.getHealth)
+	app.Use(s.requireDatabase)
+	app.Use(s.audit)
+
 	// GET requests
 	app.Get("v1/invoices/:id", s.getInvoiceById)
+	app.Get("/v1/invoices/by-client-id/:clientId", s.getInvoiceByClientId)
 	app.Get("/v1/invoices/view/:id", s.getInvoicePublicById)
 	app.Options("/v1/invoices/view/:id", s.preflightPublicView)
+	app.Get("/v1/account/callback-events", s.getCallbackEvents)
+	app.Get("/v1/account/callback-retry-policy", s.getCallbackRetryPolicy)
+	app.Get("/v1/account/callback-acknowledgement", s.getCallbackAcknowledgement)
+	app.Get("/v1/account/keys", s.getApiKeys)
+	app.Get("/v1/callbacks", s.getCallbacks)
+	app.Get("/v1/webhooks", s.getWebhooks)
+	app.Get("/v1/callbacks/:id/attempts", s.getCallbackAttempts)
 
 	// POST requests
 	app.Post("/v1/invoices", s.createInvoice)
+	app.Post("/v1/invoices/batch", s.createInvoiceBatch)
+	app.Post("/v1/invoices/:id/extend", s.extendInvoice)
+	app.Post("/v1/invoices/:id/requote", s.requoteInvoice)
+	app.Post("/v1/account/callback-events", s.updateCallbackEvents)
+	app.Post("/v1/account/callback-retry-policy", s.updateCallbackRetryPolicy)
+	app.Post("/v1/account/callback-acknowledgement", s.updateCallbackAcknowledgement)
+	app.Post("/v1/account/callback-secrets", s.rotateCallbackSecret)
+	app.Post("/v1/account/keys", s.createApiKey)
+	app.Post("/v1/callbacks/:id/redeliver", s.redeliverCallback)
+	app.Post("/v1/webhooks", s.createWebhook)
+	app.Post("/v1/webhooks/test", s.testWebhook)
+	app.Post("/v1/webhooks/:id", s.updateWebhook)
+
+	// DELETE requests
+	app.Delete("/v1/account/keys/:id", s.revokeApiKey)
+	app.Delete("/v1/webhooks/:id", s.deleteWebhook)
+
+	// Account management is only served with an admin token configured
+	if len(s.AdminToken) > 0 {
+		go s.startAdmin()
+	}
 
 	log.Info().Msg("Starting HTTP API server")
 	if err := app.Listen(fmt.Sprintf("%s:%d", s.HttpAddress, s.HttpPort)); err != nil {
@@ -0,0 +1,250 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"pkt-checkout/callback"
+	"pkt-checkout/database"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func (s *Server) getWebhooks(c *fiber.Ctx) error {
+	// Fetch account for apiKey
+	account, err := s.authenticateRequest(c, database.ApiKeyScopeAdmin)
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Fetch webhook endpoints of the account
+	webhookEndpoints, err := s.Database.FetchWebhookEndpointsByAccountId(account.Id)
+	if err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	// Secrets are only revealed to signed requests
+	details := []WebhookEndpointDetails{}
+	for _, webhookEndpoint := range webhookEndpoints {
+		webhookEndpoint.Secret = ""
+		details = append(details, craftWebhookEndpointDetails(webhookEndpoint))
+	}
+
+	return c.JSON(details)
+}
+
+func (s *Server) createWebhook(c *fiber.Ctx) error {
+	// Fetch account for apiKey and validate the signature
+	account, err := s.authenticateSignedRequest(c, database.ApiKeyScopeAdmin)
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Expected arguments
+	var arguments struct {
+		Url    string                   `json:"url"`
+		Events []database.CallbackEvent `json:"events"`
+	}
+	if err = json.Unmarshal(c.Request().Body(), &arguments); err != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", "Provided request body unexpected"))
+	}
+
+	// Validate URL
+	if apiError := s.validateWebhookUrl(arguments.Url); apiError != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(apiError)
+	}
+
+	// Validate events, an empty list subscribes to all events
+	events, apiError := validateCallbackEvents(arguments.Events)
+	if apiError != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(apiError)
+	}
+
+	// Build webhook endpoint
+	var webhookEndpoint database.WebhookEndpoint
+	webhookEndpoint.Id = uuid.New().String()
+	webhookEndpoint.AccountId = account.Id
+	webhookEndpoint.Url = arguments.Url
+	webhookEndpoint.Events = events
+	webhookEndpoint.Secret = uuid.New().String()
+	webhookEndpoint.Enabled = true
+	webhookEndpoint.CreationTime = time.Now()
+	if err = s.Database.SaveWebhookEndpoint(&webhookEndpoint); err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	setAuditTarget(c, webhookEndpoint.Id)
+	return c.JSON(craftWebhookEndpointDetails(webhookEndpoint))
+}
+
+func (s *Server) updateWebhook(c *fiber.Ctx) error {
+	// Fetch account for apiKey and validate the signature
+	account, err := s.authenticateSignedRequest(c, database.ApiKeyScopeAdmin)
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Fetch webhook endpoint for webhookId
+	webhookEndpoint, err := s.Database.FetchWebhookEndpointById(c.Params("id"))
+	if err != nil || webhookEndpoint.AccountId != account.Id {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", "Provided webhookId matches no webhook"))
+	}
+
+	// Expected arguments, fields left out remain unchanged
+	arguments := struct {
+		Url                    *string                   `json:"url"`
+		Events                 *[]database.CallbackEvent `json:"events"`
+		Enabled                *bool                     `json:"enabled"`
+		RotateSecret           bool                      `json:"rotateSecret"`
+		PreviousSecretLifetime uint16                    `json:"previousSecretLifetime"`
+	}{
+		PreviousSecretLifetime: 1440,
+	}
+	if err = json.Unmarshal(c.Request().Body(), &arguments); err != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", "Provided request body unexpected"))
+	}
+
+	// Validate previous secret lifetime
+	if arguments.PreviousSecretLifetime > 10080 {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", "Previous secret lifetime must be within 0 to 10080 minutes"))
+	}
+
+	// Validate URL
+	if arguments.Url != nil {
+		if apiError := s.validateWebhookUrl(*arguments.Url); apiError != nil {
+			c.Response().SetStatusCode(400)
+			return c.JSON(apiError)
+		}
+		webhookEndpoint.Url = *arguments.Url
+	}
+
+	// Validate events, an empty list subscribes to all events
+	if arguments.Events != nil {
+		events, apiError := validateCallbackEvents(*arguments.Events)
+		if apiError != nil {
+			c.Response().SetStatusCode(400)
+			return c.JSON(apiError)
+		}
+		webhookEndpoint.Events = events
+	}
+
+	if arguments.Enabled != nil {
+		webhookEndpoint.Enabled = *arguments.Enabled
+	}
+
+	err = s.Database.InUnitOfWork(func(uow database.UnitOfWork) error {
+		// Keep signing with the previous secrets for the remaining lifetime
+		if arguments.RotateSecret {
+			expirationTime := time.Now().Add(time.Duration(arguments.PreviousSecretLifetime) * time.Minute)
+			if err := uow.ExpireWebhookSecrets(webhookEndpoint.Id, expirationTime); err != nil {
+				return err
+			}
+			var previousSecret database.CallbackSecret
+			previousSecret.Id = uuid.New().String()
+			previousSecret.AccountId = account.Id
+			previousSecret.WebhookId = webhookEndpoint.Id
+			previousSecret.Secret = webhookEndpoint.Secret
+			previousSecret.CreationTime = time.Now()
+			previousSecret.ExpirationTime = sql.NullTime{Time: expirationTime, Valid: true}
+			if err := uow.SaveCallbackSecret(&previousSecret); err != nil {
+				return err
+			}
+			webhookEndpoint.Secret = uuid.New().String()
+		}
+
+		return uow.UpdateWebhookEndpoint(&webhookEndpoint)
+	})
+	if err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	return c.JSON(craftWebhookEndpointDetails(webhookEndpoint))
+}
+
+func (s *Server) testWebhook(c *fiber.Ctx) error {
+	// Fetch account for apiKey and validate the signature
+	account, err := s.authenticateSignedRequest(c, database.ApiKeyScopeAdmin)
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Expected arguments, either a URL or a registered webhook endpoint
+	var arguments struct {
+		Event     database.CallbackEvent `json:"event"`
+		Url       string                 `json:"url"`
+		WebhookId string                 `json:"webhookId"`
+	}
+	if err = json.Unmarshal(c.Request().Body(), &arguments); err != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(craftApiError("processing_error", "Provided request body unexpected"))
+	}
+
+	// Validate event
+	if _, apiError := validateCallbackEvents([]database.CallbackEvent{arguments.Event}); apiError != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(apiError)
+	}
+
+	// Validate destination
+	var webhookEndpoint *database.WebhookEndpoint
+	if len(arguments.WebhookId) > 0 {
+		endpoint, err := s.Database.FetchWebhookEndpointById(arguments.WebhookId)
+		if err != nil || endpoint.AccountId != account.Id {
+			c.Response().SetStatusCode(403)
+			return c.JSON(craftApiError("authentication_error", "Provided webhookId matches no webhook"))
+		}
+		webhookEndpoint = &endpoint
+	} else if apiError := s.validateWebhookUrl(arguments.Url); apiError != nil {
+		c.Response().SetStatusCode(400)
+		return c.JSON(apiError)
+	}
+
+	// Deliver synchronously and hand the outcome to the merchant
+	callbackContent, attempt := s.Callbacks.SendTestCallback(account, webhookEndpoint, arguments.Url, arguments.Event)
+	return c.JSON(struct {
+		Callback callback.CallbackContent `json:"callback"`
+		Attempt  database.CallbackAttempt `json:"attempt"`
+	}{
+		Callback: callbackContent,
+		Attempt:  attempt,
+	})
+}
+
+func (s *Server) deleteWebhook(c *fiber.Ctx) error {
+	// Fetch account for apiKey and validate the signature
+	account, err := s.authenticateSignedRequest(c, database.ApiKeyScopeAdmin)
+	if err != nil {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", err.Error()))
+	}
+
+	// Fetch webhook endpoint for webhookId
+	webhookEndpoint, err := s.Database.FetchWebhookEndpointById(c.Params("id"))
+	if err != nil || webhookEndpoint.AccountId != account.Id {
+		c.Response().SetStatusCode(403)
+		return c.JSON(craftApiError("authentication_error", "Provided webhookId matches no webhook"))
+	}
+
+	// Pending callbacks to the endpoint are abandoned on their next attempt
+	if err = s.Database.DeleteWebhookEndpoint(&webhookEndpoint); err != nil {
+		c.Response().SetStatusCode(500)
+		return c.JSON(craftApiError("processing_error", "Internal processing error"))
+	}
+
+	webhookEndpoint.Secret = ""
+	return c.JSON(craftWebhookEndpointDetails(webhookEndpoint))
+}
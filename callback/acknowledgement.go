@@ -0,0 +1,64 @@
+package callback
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"pkt-checkout/database"
+	"strings"
+)
+
+// Acknowledgement defines which responses count as successful delivery
+type Acknowledgement string
+
+const (
+	AcknowledgementStatus2xx Acknowledgement = "2xx"
+	AcknowledgementStatus200 Acknowledgement = "200"
+	AcknowledgementBody      Acknowledgement = "body"
+)
+
+var ErrNotAcknowledged = errors.New("response does not acknowledge the callback id")
+
+func (a Acknowledgement) Validate() error {
+	if a != AcknowledgementStatus2xx && a != AcknowledgementStatus200 && a != AcknowledgementBody {
+		return errors.New("callback acknowledgement must be one of 2xx, 200, body")
+	}
+	return nil
+}
+
+// WithOverride returns the account's acknowledgement, if it set a valid one
+func (a Acknowledgement) WithOverride(override string) Acknowledgement {
+	if err := Acknowledgement(override).Validate(); err != nil {
+		return a
+	}
+	return Acknowledgement(override)
+}
+
+// check evaluates the response recorded in attempt, the body acknowledgement
+// requires the callback id either as plain text or as {"id":"<callback id>"}
+func (a Acknowledgement) check(callbackId string, attempt *database.CallbackAttempt) error {
+	if a == AcknowledgementStatus200 {
+		if attempt.StatusCode != 200 {
+			return fmt.Errorf("receiver responded with status %d", attempt.StatusCode)
+		}
+		return nil
+	}
+	if attempt.StatusCode < 200 || attempt.StatusCode > 299 {
+		return fmt.Errorf("receiver responded with status %d", attempt.StatusCode)
+	}
+	if a != AcknowledgementBody {
+		return nil
+	}
+
+	responseBody := strings.TrimSpace(attempt.ResponseBody)
+	if responseBody == callbackId {
+		return nil
+	}
+	var acknowledgement struct {
+		Id string `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(responseBody), &acknowledgement); err == nil && acknowledgement.Id == callbackId {
+		return nil
+	}
+	return ErrNotAcknowledged
+}
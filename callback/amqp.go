@@ -0,0 +1,109 @@
+package callback
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"pkt-checkout/database"
+	"pkt-checkout/webhook"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var amqpRoutingKey = regexp.MustCompile("^[A-Za-z0-9_-]+(\\.[A-Za-z0-9_-]+)*$")
+
+// AmqpNotifier publishes callbacks to amqp:<routing key> destinations on the
+// configured exchange. Routing keys are prefixed with the account ID so that
+// merchants cannot publish into each other's bindings.
+type AmqpNotifier struct {
+	Url      string
+	Exchange string
+	Timeout  time.Duration
+
+	mu      sync.Mutex
+	conn    *amqp.Connection
+	channel *amqp.Channel
+}
+
+func (n *AmqpNotifier) Notify(ctx context.Context, destination *url.URL, content *CallbackContent, body []byte, signature string, attempt *database.CallbackAttempt) (time.Duration, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// (Re-)connect lazily, the broker may have been unavailable so far
+	if err := n.connect(); err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, n.Timeout)
+	defer cancel()
+
+	// Publish and wait for the broker to confirm
+	routingKey := strconv.FormatUint(uint64(content.Invoice.AccountId), 10) + "." + destination.Opaque
+	confirmation, err := n.channel.PublishWithDeferredConfirmWithContext(ctx, n.Exchange, routingKey, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    content.Id,
+		Type:         string(content.Event),
+		Timestamp:    time.Now(),
+		Headers:      amqp.Table{webhook.SignatureHeader: signature},
+		Body:         body,
+	})
+	if err != nil {
+		n.close()
+		return 0, err
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		n.close()
+		return 0, err
+	}
+	if !acked {
+		return 0, errors.New("broker rejected the message")
+	}
+
+	return 0, nil
+}
+
+func (n *AmqpNotifier) connect() error {
+	if n.conn != nil && !n.conn.IsClosed() && n.channel != nil && !n.channel.IsClosed() {
+		return nil
+	}
+	n.close()
+
+	conn, err := amqp.DialConfig(n.Url, amqp.Config{Dial: amqp.DefaultDial(n.Timeout)})
+	if err != nil {
+		return err
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if err = channel.Confirm(false); err != nil {
+		conn.Close()
+		return err
+	}
+
+	n.conn = conn
+	n.channel = channel
+	return nil
+}
+
+func (n *AmqpNotifier) close() {
+	if n.conn != nil {
+		n.conn.Close()
+	}
+	n.conn = nil
+	n.channel = nil
+}
+
+func (n *AmqpNotifier) ValidateDestination(ctx context.Context, destination *url.URL) error {
+	if !amqpRoutingKey.MatchString(destination.Opaque) {
+		return errors.New("amqp destination must be amqp:<routing key> of dot separated words")
+	}
+	return nil
+}
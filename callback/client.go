@@ -0,0 +1,149 @@
+package callback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var ErrForbiddenAddress = errors.New("callback destination address is not publicly routable")
+
+// Reserved ranges not already covered by the netip.Addr predicates
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/23"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+}
+
+type AddressGuard struct {
+	AllowedNetworks []netip.Prefix
+}
+
+func NewAddressGuard() (*AddressGuard, error) {
+	guard := AddressGuard{}
+
+	if viper.IsSet("callback-allowed-networks") {
+		for _, network := range viper.GetStringSlice("callback-allowed-networks") {
+			prefix, err := netip.ParsePrefix(network)
+			if err != nil {
+				return nil, fmt.Errorf("callback-allowed-networks: %w", err)
+			}
+			guard.AllowedNetworks = append(guard.AllowedNetworks, prefix)
+		}
+	}
+
+	return &guard, nil
+}
+
+func (g *AddressGuard) Allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	// Explicitly allowed networks take precedence
+	for _, prefix := range g.AllowedNetworks {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	// Loopback, link-local, multicast, unspecified and private ranges
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ValidateUrl rejects callback URLs which are not https or resolve to
+// addresses the callback client would refuse to connect to
+func (g *AddressGuard) ValidateUrl(ctx context.Context, callbackUrl string) error {
+	uri, err := url.ParseRequestURI(callbackUrl)
+	if err != nil {
+		return err
+	}
+	if uri.Scheme != "https" || len(uri.Hostname()) == 0 {
+		return errors.New("callback URL must be https")
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", uri.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !g.Allowed(addr) {
+			return ErrForbiddenAddress
+		}
+	}
+
+	return nil
+}
+
+// Validates the address actually being connected to, after DNS resolution,
+// so that rebinding the name after ValidateUrl gains nothing
+func (g *AddressGuard) control(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !g.Allowed(addr) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
+
+func NewCallbackClient(guard *AddressGuard, timeout time.Duration, maxRedirects int) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: guard.control,
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// Proxies from the environment would bypass the address guard
+			Proxy:                  nil,
+			DialContext:            dialer.DialContext,
+			ForceAttemptHTTP2:      true,
+			TLSHandshakeTimeout:    timeout,
+			ResponseHeaderTimeout:  timeout,
+			MaxResponseHeaderBytes: 16 << 10,
+			MaxIdleConns:           100,
+			IdleConnTimeout:        90 * time.Second,
+		},
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if request.URL.Scheme != "https" {
+				return errors.New("redirect to non-https URL")
+			}
+			return nil
+		},
+	}
+}
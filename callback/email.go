@@ -0,0 +1,124 @@
+package callback
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"pkt-checkout/database"
+	"pkt-checkout/webhook"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EmailNotifier delivers callbacks to mailto: destinations through an SMTP
+// relay, STARTTLS is used whenever the relay offers it
+type EmailNotifier struct {
+	Address string
+	Port    uint16
+	User    string
+	Pass    string
+	From    string
+	Timeout time.Duration
+}
+
+func (n *EmailNotifier) Notify(ctx context.Context, destination *url.URL, content *CallbackContent, body []byte, signature string, attempt *database.CallbackAttempt) (time.Duration, error) {
+	recipient, err := mail.ParseAddress(destination.Opaque)
+	if err != nil {
+		return 0, err
+	}
+
+	// Connect to the relay
+	deadline := time.Now().Add(n.Timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(n.Address, fmt.Sprint(n.Port)))
+	if err != nil {
+		return 0, err
+	}
+	conn.SetDeadline(deadline)
+	client, err := smtp.NewClient(conn, n.Address)
+	if err != nil {
+		conn.Close()
+		return 0, err
+	}
+	defer client.Close()
+
+	// Secure and authenticate the session where possible
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(&tls.Config{ServerName: n.Address}); err != nil {
+			return 0, err
+		}
+	}
+	if len(n.User) > 0 {
+		if err = client.Auth(smtp.PlainAuth("", n.User, n.Pass, n.Address)); err != nil {
+			return 0, err
+		}
+	}
+
+	// Submit the message
+	if err = client.Mail(n.From); err != nil {
+		return 0, err
+	}
+	if err = client.Rcpt(recipient.Address); err != nil {
+		return 0, err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return 0, err
+	}
+	if _, err = writer.Write(n.message(recipient, content, body, signature)); err != nil {
+		return 0, err
+	}
+	if err = writer.Close(); err != nil {
+		return 0, err
+	}
+	return 0, client.Quit()
+}
+
+func (n *EmailNotifier) message(recipient *mail.Address, content *CallbackContent, body []byte, signature string) []byte {
+	subject := fmt.Sprintf("PKT Checkout %s: invoice %s", content.Event, content.Invoice.Id)
+	if content.Test {
+		subject = "[TEST] " + subject
+	}
+
+	// The JSON body is quoted-printable encoded, keeping lines within the
+	// RFC 5322 limit while decoding to the exact bytes that were signed
+	var message strings.Builder
+	message.WriteString("From: " + n.From + "\r\n")
+	message.WriteString("To: " + recipient.String() + "\r\n")
+	message.WriteString("Subject: " + subject + "\r\n")
+	message.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	message.WriteString("Message-ID: <" + uuid.New().String() + "@pkt-checkout>\r\n")
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: application/json; charset=utf-8\r\n")
+	message.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	message.WriteString(webhook.SignatureHeader + ": " + signature + "\r\n")
+	message.WriteString("\r\n")
+	encoder := quotedprintable.NewWriter(&message)
+	encoder.Binary = true
+	encoder.Write(body)
+	encoder.Close()
+	message.WriteString("\r\n")
+	return []byte(message.String())
+}
+
+func (n *EmailNotifier) ValidateDestination(ctx context.Context, destination *url.URL) error {
+	if len(destination.Opaque) == 0 {
+		return errors.New("mailto destination must be mailto:user@example.com")
+	}
+	address, err := mail.ParseAddress(destination.Opaque)
+	if err != nil || address.Address != destination.Opaque {
+		return errors.New("mailto destination must be mailto:user@example.com")
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package callback
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/url"
+	"pkt-checkout/database"
+	"pkt-checkout/webhook"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpSession is what the fake relay received
+type smtpSession struct {
+	from string
+	to   []string
+	data string
+	err  error
+}
+
+// fakeSmtpRelay accepts a single session on a local listener, offering
+// neither STARTTLS nor AUTH
+func fakeSmtpRelay(t *testing.T) (uint16, <-chan smtpSession) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	sessions := make(chan smtpSession, 1)
+	go func() {
+		var session smtpSession
+		defer func() { sessions <- session }()
+		conn, err := listener.Accept()
+		if err != nil {
+			session.err = err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+		reply("220 localhost ESMTP")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				session.err = err
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			verb, argument, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(verb) {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "MAIL":
+				session.from = strings.Trim(strings.TrimPrefix(argument, "FROM:"), "<>")
+				reply("250 OK")
+			case "RCPT":
+				session.to = append(session.to, strings.Trim(strings.TrimPrefix(argument, "TO:"), "<>"))
+				reply("250 OK")
+			case "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				var data strings.Builder
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						session.err = err
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(strings.TrimPrefix(line, "."))
+				}
+				session.data = data.String()
+				reply("250 OK")
+			case "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				reply("502 Command not implemented")
+			}
+		}
+	}()
+
+	return uint16(listener.Addr().(*net.TCPAddr).Port), sessions
+}
+
+func TestEmailNotifier(t *testing.T) {
+	port, sessions := fakeSmtpRelay(t)
+	notifier := EmailNotifier{
+		Address: "127.0.0.1",
+		Port:    port,
+		From:    "checkout@example.com",
+		Timeout: 5 * time.Second,
+	}
+
+	// Long enough a body to need wrapping
+	content := CallbackContent{
+		Id:       "2f1b0a86-5c53-4f3e-8f0e-2b9d0a0c7a11",
+		Event:    database.CallbackEventInvoicePaid,
+		Sequence: 1,
+		Invoice: database.Invoice{
+			Id:                 "e0b3c5a4-7d2e-4b8a-9a1f-6c1d2e3f4a5b",
+			PaymentDescription: strings.Repeat("é", 600),
+		},
+	}
+	body := []byte(`{"id":"` + content.Id + `","event":"invoice.paid","invoice":{"paymentDescription":"` + content.Invoice.PaymentDescription + `"}}`)
+	signature := webhook.Sign(body, time.Now(), "secret")
+	destination, _ := url.Parse("mailto:billing@example.com")
+
+	if _, err := notifier.Notify(context.Background(), destination, &content, body, signature, &database.CallbackAttempt{}); err != nil {
+		t.Fatalf("notifying: %v", err)
+	}
+	session := <-sessions
+	if session.err != nil {
+		t.Fatalf("relay session: %v", session.err)
+	}
+
+	// Envelope
+	if session.from != "checkout@example.com" {
+		t.Errorf("envelope sender %q", session.from)
+	}
+	if len(session.to) != 1 || session.to[0] != "billing@example.com" {
+		t.Errorf("envelope recipients %q", session.to)
+	}
+
+	// Lines, CRLF excluded, must stay within RFC 5322's 998 characters
+	for i, line := range strings.Split(session.data, "\r\n") {
+		if len(line) > 998 {
+			t.Errorf("line %d is %d characters long", i+1, len(line))
+		}
+	}
+
+	// Headers
+	message, err := mail.ReadMessage(strings.NewReader(session.data))
+	if err != nil {
+		t.Fatalf("parsing message: %v", err)
+	}
+	headers := map[string]string{
+		"From":                      "checkout@example.com",
+		"To":                        "<billing@example.com>",
+		"Subject":                   "PKT Checkout invoice.paid: invoice e0b3c5a4-7d2e-4b8a-9a1f-6c1d2e3f4a5b",
+		"Content-Type":              "application/json; charset=utf-8",
+		"Content-Transfer-Encoding": "quoted-printable",
+		webhook.SignatureHeader:     signature,
+	}
+	for key, want := range headers {
+		if got := message.Header.Get(key); got != want {
+			t.Errorf("header %s is %q, want %q", key, got, want)
+		}
+	}
+
+	// The decoded body is the signed JSON
+	decoded, err := io.ReadAll(quotedprintable.NewReader(message.Body))
+	if err != nil {
+		t.Fatalf("decoding body: %v", err)
+	}
+	decoded = []byte(strings.TrimSuffix(string(decoded), "\r\n"))
+	if string(decoded) != string(body) {
+		t.Fatalf("body is %q, want %q", decoded, body)
+	}
+	if err = webhook.Verify(decoded, message.Header.Get(webhook.SignatureHeader), time.Minute, "secret"); err != nil {
+		t.Fatalf("verifying body signature: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package callback
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"pkt-checkout/database"
+	"pkt-checkout/webhook"
+	"strings"
+	"time"
+)
+
+// Notifier delivers signed callback content to a destination of its URL
+// scheme. Implementations record what they learn about the delivery in the
+// attempt and return the delay the receiver asked for before retrying.
+// Responses recorded with a status code are subject to the acknowledgement
+// criteria of the account.
+type Notifier interface {
+	Notify(ctx context.Context, destination *url.URL, content *CallbackContent, body []byte, signature string, attempt *database.CallbackAttempt) (time.Duration, error)
+	ValidateDestination(ctx context.Context, destination *url.URL) error
+}
+
+type HttpNotifier struct {
+	Client *http.Client
+	Guard  *AddressGuard
+}
+
+func (n *HttpNotifier) Notify(ctx context.Context, destination *url.URL, content *CallbackContent, body []byte, signature string, attempt *database.CallbackAttempt) (time.Duration, error) {
+	// Build request
+	request, err := http.NewRequestWithContext(ctx, "POST", destination.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "PKT-Checkout")
+	request.Header.Set(webhook.SignatureHeader, signature)
+
+	// Send request
+	response, err := n.Client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+
+	// Keep the beginning of the response for troubleshooting
+	responseBody, err := io.ReadAll(io.LimitReader(response.Body, database.CallbackAttemptBodyLimit))
+	response.Body.Close()
+	attempt.StatusCode = response.StatusCode
+	attempt.ResponseBody = strings.ToValidUTF8(string(responseBody), "")
+	return parseRetryAfter(response), err
+}
+
+func (n *HttpNotifier) ValidateDestination(ctx context.Context, destination *url.URL) error {
+	return n.Guard.ValidateUrl(ctx, destination.String())
+}
@@ -1,75 +1,287 @@
 package callback
 
 import (
-	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
-	"net/http"
 	"pkt-checkout/database"
+	"pkt-checkout/webhook"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 type CallbackContent struct {
-	Id        string           `json:"id"`
-	Signature string           `json:"signature"`
-	Invoice   database.Invoice `json:"invoice"`
+	Id        string                 `json:"id"`
+	Event     database.CallbackEvent `json:"event"`
+	Sequence  int                    `json:"sequence"`
+	Test      bool                   `json:"test,omitempty"`
+	Signature string                 `json:"signature"`
+	Invoice   database.Invoice       `json:"invoice"`
+}
+
+func (s *Server) RequestCallback(invoice database.Invoice, event database.CallbackEvent) error {
+	return s.Database.InUnitOfWork(func(uow database.UnitOfWork) error {
+		return EnqueueCallback(uow, invoice, event)
+	})
 }
 
-func (s *Server) sendCallbackRequest(callback database.Callback) {
-	// Fetch the corresponding invoice from database
-	invoice, err := database.FetchInvoiceById(callback.InvoiceId)
+// EnqueueCallback requests callbacks as part of a unit of work, they are
+// delivered only once it commits
+func EnqueueCallback(uow database.UnitOfWork, invoice database.Invoice, event database.CallbackEvent) error {
+	// Fetch the corresponding account from database
+	account, err := uow.FetchAccountById(invoice.AccountId)
 	if err != nil {
-		s.failedCallbackRequest(callback)
-		return
+		return err
+	}
+
+	// Invoice callback URLs override the webhook endpoints of the account
+	if len(invoice.CallbackUrl) > 0 {
+		// Merchants may subscribe to a subset of events
+		if !account.SubscribesTo(event) {
+			return nil
+		}
+		return saveCallback(uow, invoice, "", event)
+	}
+
+	// Fan out to every enabled webhook endpoint subscribed to the event
+	webhookEndpoints, err := uow.FetchWebhookEndpointsByAccountId(account.Id)
+	if err != nil {
+		return err
 	}
+	for _, webhookEndpoint := range webhookEndpoints {
+		if !webhookEndpoint.Enabled || !webhookEndpoint.SubscribesTo(event) {
+			continue
+		}
+		if err := saveCallback(uow, invoice, webhookEndpoint.Id, event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func saveCallback(uow database.UnitOfWork, invoice database.Invoice, webhookId string, event database.CallbackEvent) error {
+	var callback database.Callback
+	callback.Id = uuid.New().String()
+	callback.InvoiceId = invoice.Id
+	callback.WebhookId = webhookId
+	callback.Event = event
+	callback.RequestTime = time.Now()
+	callback.NextReqTime = time.Now()
+	callback.ReqErrors = 0
+	callback.Status = database.CallbackStatusCreated
+	if err := uow.SaveCallback(&callback); err != nil {
+		return err
+	}
+
+	// Deliver right away once committed
+	uow.AfterCommit(notify)
+
+	return nil
+}
+
+func (s *Server) sendCallbackRequest(callback database.Callback, invoice database.Invoice, webhookEndpoint *database.WebhookEndpoint) {
+	attempt := newCallbackAttempt(callback)
 
 	// Fetch the corresponding account from database
-	account, err := database.FetchAccountById(invoice.AccountId)
+	account, err := s.Database.FetchAccountById(invoice.AccountId)
 	if err != nil {
-		s.failedCallbackRequest(callback)
+		s.failedCallbackRequest(callback, attempt.WithError(err), s.RetryPolicy, 0)
 		return
 	}
 
-	// Sign the ID for HMAC authentication by recipient
-	h := hmac.New(sha256.New, []byte(account.SecretKey))
-	h.Write([]byte(callback.Id))
-	signature := hex.EncodeToString(h.Sum(nil))
+	// Accounts may override the global retry policy
+	policy, _ := s.RetryPolicy.WithOverride(account.CallbackRetryPolicy)
 
 	// Assemeble the content to transmit
 	var callbackContent CallbackContent
 	callbackContent.Id = callback.Id
-	callbackContent.Signature = signature
+	callbackContent.Event = callback.Event
+	callbackContent.Sequence = callback.Sequence
 	callbackContent.Invoice = invoice
 
+	// Attempt sending request
+	retryAfter, err := s.postCallback(account, webhookEndpoint, invoice.CallbackUrl, &callbackContent, &attempt)
+	if err != nil {
+		s.failedCallbackRequest(callback, attempt.WithError(err), policy, retryAfter)
+		return
+	}
+
+	// OK
+	s.Database.SaveCallbackAttempt(&attempt)
+	callback.Status = database.CallbackStatusDelivered
+	s.Database.UpdateCallback(&callback)
+}
+
+func (s *Server) SendTestCallback(account database.Account, webhookEndpoint *database.WebhookEndpoint, callbackUrl string, event database.CallbackEvent) (CallbackContent, database.CallbackAttempt) {
+	// Synthetic invoice in the state following the event
+	var invoice database.Invoice
+	invoice.Id = uuid.New().String()
+	invoice.ClientId = "test"
+	invoice.AccountId = account.Id
+	invoice.PaymentAmount = 1000
+	invoice.PaymentAddress = "pkt1q4h38kq2rzcz92h7hwexjkztv72dv9w32l72azm"
+	invoice.PaymentDescription = "Test invoice"
+	invoice.CallbackUrl = callbackUrl
+	invoice.CreationTime = time.Now()
+	invoice.ExpirationTime = time.Now().Add(15 * time.Minute)
+	switch event {
+	case database.CallbackEventInvoicePaymentDetected, database.CallbackEventInvoicePaymentConfirmed:
+		invoice.Status = database.InvoiceStatusPending
+	case database.CallbackEventInvoicePaid:
+		invoice.Status = database.InvoiceStatusPaid
+	case database.CallbackEventInvoiceExpired:
+		invoice.Status = database.InvoiceStatusExpired
+		invoice.ExpirationTime = time.Now()
+	default:
+		invoice.Status = database.InvoiceStatusCreated
+	}
+
+	// Assemeble the content to transmit, clearly flagged as test
+	var callbackContent CallbackContent
+	callbackContent.Id = uuid.New().String()
+	callbackContent.Event = event
+	callbackContent.Sequence = 0
+	callbackContent.Test = true
+	callbackContent.Invoice = invoice
+
+	// Attempt sending request once, without recording it
+	var attempt database.CallbackAttempt
+	attempt.Id = callbackContent.Id
+	attempt.AttemptTime = time.Now()
+	_, err := s.postCallback(account, webhookEndpoint, callbackUrl, &callbackContent, &attempt)
+	return callbackContent, attempt.WithError(err)
+}
+
+func (s *Server) postCallback(account database.Account, webhookEndpoint *database.WebhookEndpoint, callbackUrl string, callbackContent *CallbackContent, attempt *database.CallbackAttempt) (time.Duration, error) {
+	// Webhook endpoints have secrets of their own
+	legacySecret := account.SecretKey
+	var secrets []string
+	var err error
+	if webhookEndpoint != nil {
+		callbackUrl = webhookEndpoint.Url
+		legacySecret = webhookEndpoint.Secret
+		secrets, err = s.webhookSecrets(*webhookEndpoint)
+	} else {
+		secrets, err = s.callbackSecrets(account)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Sign the ID for HMAC authentication by recipients predating X-PKT-Signature
+	h := hmac.New(sha256.New, []byte(legacySecret))
+	h.Write([]byte(callbackContent.Id))
+	callbackContent.Signature = hex.EncodeToString(h.Sum(nil))
+
 	// Encode to JSON
 	encodedContent, err := json.Marshal(callbackContent)
 	if err != nil {
-		s.failedCallbackRequest(callback)
-		return
+		return 0, err
 	}
 
-	// Attempt sending request
-	response, err := http.Post(invoice.CallbackUrl, "application/json", bytes.NewReader(encodedContent))
-	if err != nil || response.StatusCode != 200 {
-		s.failedCallbackRequest(callback)
-		return
+	// Hand over to the notifier of the destination's channel
+	destination, notifier, err := s.notifier(callbackUrl)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*s.Timeout)
+	defer cancel()
+	signature := webhook.Sign(encodedContent, time.Now(), secrets...)
+	retryAfter, err := notifier.Notify(ctx, destination, callbackContent, encodedContent, signature, attempt)
+	attempt.Latency = time.Since(attempt.AttemptTime).Milliseconds()
+	if err != nil {
+		return retryAfter, err
 	}
 
-	// OK
-	callback.Status = database.CallbackStatusDelivered
-	callback.Update()
+	// Receivers answering with a response have to acknowledge as the account requires
+	if attempt.StatusCode != 0 {
+		err = s.Acknowledgement.WithOverride(account.CallbackAcknowledgement).check(callbackContent.Id, attempt)
+	}
+	return retryAfter, err
 }
 
-func (s *Server) failedCallbackRequest(callback database.Callback) {
+func (s *Server) failedCallbackRequest(callback database.Callback, attempt database.CallbackAttempt, policy RetryPolicy, retryAfter time.Duration) {
+	// Record the cause
+	s.Database.SaveCallbackAttempt(&attempt)
+
 	// Retry at a later time, or give up
 	callback.ReqErrors++
-	if callback.ReqErrors >= s.Attempts {
+	delay, retry := policy.nextRetry(callback, classifyFailure(attempt.StatusCode), retryAfter)
+	if !retry {
 		callback.Status = database.CallbackStatusFailed
-		callback.Update()
+		s.Database.UpdateCallback(&callback)
 		return
 	}
-	callback.NextReqTime = time.Now().Add(time.Duration(callback.ReqErrors) * (time.Duration(s.Backoff) * time.Minute))
-	callback.Update()
+	callback.NextReqTime = time.Now().Add(delay)
+	s.Database.UpdateCallback(&callback)
+}
+
+func (s *Server) abandonCallbackRequest(callback database.Callback, attempt database.CallbackAttempt) {
+	// Record the cause
+	s.Database.SaveCallbackAttempt(&attempt)
+
+	// Dead-letter without further attempts
+	callback.ReqErrors++
+	callback.Status = database.CallbackStatusFailed
+	s.Database.UpdateCallback(&callback)
+}
+
+func (s *Server) RequeueCallback(callback database.Callback) error {
+	// Start over as if freshly requested
+	callback.NextReqTime = time.Now()
+	callback.ReqErrors = 0
+	callback.Status = database.CallbackStatusCreated
+	if err := s.Database.UpdateCallback(&callback); err != nil {
+		return err
+	}
+
+	// Deliver right away
+	notify()
+
+	return nil
+}
+
+func newCallbackAttempt(callback database.Callback) database.CallbackAttempt {
+	var attempt database.CallbackAttempt
+	attempt.Id = uuid.New().String()
+	attempt.CallbackId = callback.Id
+	attempt.AttemptTime = time.Now()
+	return attempt
+}
+
+func (s *Server) callbackSecrets(account database.Account) ([]string, error) {
+	callbackSecrets, err := s.Database.FetchActiveCallbackSecrets(account.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Accounts which never rotated sign with their secretKey
+	if len(callbackSecrets) == 0 {
+		return []string{account.SecretKey}, nil
+	}
+
+	var secrets []string
+	for _, callbackSecret := range callbackSecrets {
+		secrets = append(secrets, callbackSecret.Secret)
+	}
+	return secrets, nil
+}
+
+// webhookSecrets returns the current secret of the webhook endpoint along
+// with the previous ones still within their lifetime
+func (s *Server) webhookSecrets(webhookEndpoint database.WebhookEndpoint) ([]string, error) {
+	previousSecrets, err := s.Database.FetchActiveWebhookSecrets(webhookEndpoint.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := []string{webhookEndpoint.Secret}
+	for _, previousSecret := range previousSecrets {
+		secrets = append(secrets, previousSecret.Secret)
+	}
+	return secrets, nil
 }
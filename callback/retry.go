@@ -0,0 +1,219 @@
+package callback
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"pkt-checkout/database"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type RetryStrategy string
+
+const (
+	RetryStrategyLinear      RetryStrategy = "linear"
+	RetryStrategyExponential RetryStrategy = "exponential"
+	RetryStrategySchedule    RetryStrategy = "schedule"
+)
+
+// Limits keeping merchant overrides from retrying forever or computing
+// delays beyond what time.Duration holds
+const (
+	retryMaxAttempts = 100
+	retryMaxMinutes  = 7 * 24 * 60
+	retryMaxDelay    = retryMaxMinutes * time.Minute
+)
+
+// failureClass tells apart why an attempt failed, receivers which were not
+// reached at all get attempts of their own
+type failureClass int
+
+const (
+	failureServer failureClass = iota
+	failureClient
+	failureNetwork
+)
+
+func classifyFailure(statusCode int) failureClass {
+	switch {
+	case statusCode == 0:
+		return failureNetwork
+	case statusCode >= 400 && statusCode < 500 && statusCode != http.StatusRequestTimeout && statusCode != http.StatusTooManyRequests:
+		return failureClient
+	}
+	return failureServer
+}
+
+// Durations are in minutes, as throughout the configuration file
+type RetryPolicy struct {
+	Strategy             RetryStrategy `json:"strategy"`
+	Attempts             int           `json:"attempts"`
+	ClientErrorAttempts  int           `json:"clientErrorAttempts"`
+	NetworkErrorAttempts int           `json:"networkErrorAttempts"`
+	Backoff              int           `json:"backoff"`
+	BackoffMax           int           `json:"backoffMax"`
+	Jitter               int           `json:"jitter"`
+	Schedule             []int         `json:"schedule"`
+	Budget               int           `json:"budget"`
+}
+
+func NewRetryPolicy() RetryPolicy {
+	policy := RetryPolicy{
+		Strategy:             RetryStrategyLinear,
+		Attempts:             viper.GetInt("callback-attempts"),
+		ClientErrorAttempts:  2,
+		NetworkErrorAttempts: viper.GetInt("callback-attempts"),
+		Backoff:              viper.GetInt("callback-backoff"),
+		BackoffMax:           1440,
+		Jitter:               0,
+		Schedule:             nil,
+		Budget:               0,
+	}
+
+	if viper.IsSet("callback-retry-strategy") {
+		policy.Strategy = RetryStrategy(viper.GetString("callback-retry-strategy"))
+	}
+
+	if viper.IsSet("callback-client-error-attempts") {
+		policy.ClientErrorAttempts = viper.GetInt("callback-client-error-attempts")
+	}
+
+	if viper.IsSet("callback-network-error-attempts") {
+		policy.NetworkErrorAttempts = viper.GetInt("callback-network-error-attempts")
+	}
+
+	if viper.IsSet("callback-backoff-max") {
+		policy.BackoffMax = viper.GetInt("callback-backoff-max")
+	}
+
+	if viper.IsSet("callback-jitter") {
+		policy.Jitter = viper.GetInt("callback-jitter")
+	}
+
+	if viper.IsSet("callback-schedule") {
+		policy.Schedule = viper.GetIntSlice("callback-schedule")
+	}
+
+	if viper.IsSet("callback-budget") {
+		policy.Budget = viper.GetInt("callback-budget")
+	}
+
+	return policy
+}
+
+func (p RetryPolicy) Validate() error {
+	if p.Strategy != RetryStrategyLinear && p.Strategy != RetryStrategyExponential && p.Strategy != RetryStrategySchedule {
+		return errors.New("retry strategy must be one of linear, exponential, schedule")
+	}
+	for _, attempts := range []int{p.Attempts, p.ClientErrorAttempts, p.NetworkErrorAttempts} {
+		if attempts < 1 || attempts > retryMaxAttempts {
+			return fmt.Errorf("retry attempts must be within 1 to %d", retryMaxAttempts)
+		}
+	}
+	for _, delay := range append([]int{p.Backoff, p.BackoffMax}, p.Schedule...) {
+		if delay < 0 || delay > retryMaxMinutes {
+			return fmt.Errorf("retry delays must be within 0 to %d minutes", retryMaxMinutes)
+		}
+	}
+	if p.Budget < 0 || p.Budget > retryMaxAttempts*retryMaxMinutes {
+		return fmt.Errorf("retry budget must be within 0 to %d minutes", retryMaxAttempts*retryMaxMinutes)
+	}
+	if p.Jitter < 0 || p.Jitter > 100 {
+		return errors.New("retry jitter must be within 0 to 100 percent")
+	}
+	if p.Strategy == RetryStrategySchedule && len(p.Schedule) == 0 {
+		return errors.New("retry schedule must list at least one delay")
+	}
+	return nil
+}
+
+// WithOverride applies the fields present in an account's JSON encoded
+// override on top of the policy
+func (p RetryPolicy) WithOverride(override string) (RetryPolicy, error) {
+	if len(override) == 0 {
+		return p, nil
+	}
+
+	policy := p
+	policy.Schedule = append([]int(nil), p.Schedule...)
+	if err := json.Unmarshal([]byte(override), &policy); err != nil {
+		return p, err
+	}
+	if err := policy.Validate(); err != nil {
+		return p, err
+	}
+	return policy, nil
+}
+
+// nextRetry returns the delay before the next attempt of a callback which
+// has just failed for the ReqErrors time, or false to give up
+func (p RetryPolicy) nextRetry(callback database.Callback, failure failureClass, retryAfter time.Duration) (time.Duration, bool) {
+	attempts := p.Attempts
+	switch failure {
+	case failureClient:
+		// Receivers rejecting the request are unlikely to change their mind
+		attempts = min(attempts, p.ClientErrorAttempts)
+	case failureNetwork:
+		// Receivers which could not be reached may be down for longer than
+		// ones failing to process the request
+		attempts = p.NetworkErrorAttempts
+	}
+	if callback.ReqErrors >= attempts {
+		return 0, false
+	}
+
+	// Base delay
+	var minutes float64
+	switch p.Strategy {
+	case RetryStrategyExponential:
+		minutes = float64(p.Backoff) * math.Pow(2, float64(callback.ReqErrors-1))
+	case RetryStrategySchedule:
+		minutes = float64(p.Schedule[min(callback.ReqErrors, len(p.Schedule))-1])
+	default:
+		minutes = float64(callback.ReqErrors * p.Backoff)
+	}
+	if p.BackoffMax > 0 {
+		minutes = math.Min(minutes, float64(p.BackoffMax))
+	}
+	minutes = math.Min(minutes, retryMaxMinutes)
+
+	// Spread out retries of callbacks which failed together
+	if p.Jitter > 0 {
+		minutes += minutes * float64(p.Jitter) / 100 * (2*rand.Float64() - 1)
+	}
+	delay := time.Duration(minutes * float64(time.Minute))
+
+	// Receivers may ask for more time, within reason
+	if retryAfter > delay {
+		delay = min(retryAfter, retryMaxDelay)
+	}
+
+	// Give up once the next attempt would exceed the total time budget
+	if p.Budget > 0 && time.Now().Add(delay).After(callback.RequestTime.Add(time.Duration(p.Budget)*time.Minute)) {
+		return 0, false
+	}
+
+	return delay, true
+}
+
+func parseRetryAfter(response *http.Response) time.Duration {
+	retryAfter := response.Header.Get("Retry-After")
+	if len(retryAfter) == 0 {
+		return 0
+	}
+
+	// Either delay in seconds or HTTP date
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(retryAfter); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
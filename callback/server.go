@@ -1,38 +1,256 @@
 package callback
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"net/mail"
+	"net/url"
 	"pkt-checkout/database"
+	"sync"
 	"time"
 
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 )
 
+var (
+	ErrWebhookDisabled    = errors.New("webhook endpoint disabled")
+	ErrUnsupportedChannel = errors.New("destination must be an https:, mailto: or amqp: URL of a configured channel")
+)
+
+// Signals the dispatcher that callbacks were enqueued or delivery slots freed up
+var wakeup = make(chan struct{}, 1)
+
 type Server struct {
-	Attempts int
-	Backoff  int
+	Database        database.Store
+	RetryPolicy     RetryPolicy
+	Acknowledgement Acknowledgement
+	Workers         int
+	HostConcurrency int
+	Timeout         time.Duration
+	MaxRedirects    int
+	Guard           *AddressGuard
+	Client          *http.Client
+	Notifiers       map[string]Notifier
+
+	workers chan struct{}
+	hostsMu sync.Mutex
+	hosts   map[string]int
+}
+
+func NewServer(store database.Store) *Server {
+	server := Server{
+		Database:        store,
+		RetryPolicy:     NewRetryPolicy(),
+		Acknowledgement: AcknowledgementStatus2xx,
+		Workers:         8,
+		HostConcurrency: 2,
+		Timeout:         10 * time.Second,
+		MaxRedirects:    3,
+		hosts:           make(map[string]int),
+	}
+
+	if viper.IsSet("callback-workers") {
+		server.Workers = viper.GetInt("callback-workers")
+	}
+
+	if viper.IsSet("callback-host-concurrency") {
+		server.HostConcurrency = viper.GetInt("callback-host-concurrency")
+	}
+
+	if viper.IsSet("callback-timeout") {
+		server.Timeout = time.Duration(viper.GetInt("callback-timeout")) * time.Second
+	}
+
+	if viper.IsSet("callback-max-redirects") {
+		server.MaxRedirects = viper.GetInt("callback-max-redirects")
+	}
+
+	if viper.IsSet("callback-acknowledgement") {
+		server.Acknowledgement = Acknowledgement(viper.GetString("callback-acknowledgement"))
+	}
+
+	if err := server.Acknowledgement.Validate(); err != nil {
+		log.Fatal().Err(err).Msg("Interpreting callback acknowledgement failed")
+	}
+
+	if err := server.RetryPolicy.Validate(); err != nil {
+		log.Fatal().Err(err).Msg("Interpreting callback retry policy failed")
+	}
+
+	guard, err := NewAddressGuard()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Interpreting callback allowed networks failed")
+	}
+	server.Guard = guard
+	server.Client = NewCallbackClient(server.Guard, server.Timeout, server.MaxRedirects)
+	server.workers = make(chan struct{}, server.Workers)
+
+	// Channels are keyed by destination URL scheme, email and AMQP are opt-in
+	server.Notifiers = map[string]Notifier{
+		"https": &HttpNotifier{Client: server.Client, Guard: server.Guard},
+	}
+	if viper.IsSet("callback-smtp-address") {
+		email := EmailNotifier{
+			Address: viper.GetString("callback-smtp-address"),
+			Port:    25,
+			User:    viper.GetString("callback-smtp-user"),
+			Pass:    viper.GetString("callback-smtp-pass"),
+			From:    viper.GetString("callback-smtp-from"),
+			Timeout: server.Timeout,
+		}
+		if viper.IsSet("callback-smtp-port") {
+			email.Port = uint16(viper.GetUint("callback-smtp-port"))
+		}
+		if _, err := mail.ParseAddress(email.From); err != nil {
+			log.Fatal().Err(err).Msg("Interpreting callback-smtp-from failed")
+		}
+		server.Notifiers["mailto"] = &email
+	}
+	if viper.IsSet("callback-amqp-url") {
+		broker := AmqpNotifier{
+			Url:      viper.GetString("callback-amqp-url"),
+			Exchange: "pkt-checkout",
+			Timeout:  server.Timeout,
+		}
+		if viper.IsSet("callback-amqp-exchange") {
+			broker.Exchange = viper.GetString("callback-amqp-exchange")
+		}
+		server.Notifiers["amqp"] = &broker
+	}
+
+	return &server
 }
 
-func NewServer() *Server {
-	return &Server{
-		Attempts: viper.GetInt("callback-attempts"),
-		Backoff:  viper.GetInt("callback-backoff"),
+// ValidateDestination rejects destinations without a configured channel or
+// which the channel would refuse to deliver to
+func (s *Server) ValidateDestination(ctx context.Context, destination string) error {
+	uri, notifier, err := s.notifier(destination)
+	if err != nil {
+		return err
 	}
+	return notifier.ValidateDestination(ctx, uri)
+}
+
+func (s *Server) notifier(destination string) (*url.URL, Notifier, error) {
+	uri, err := url.Parse(destination)
+	if err != nil {
+		return nil, nil, err
+	}
+	notifier, ok := s.Notifiers[uri.Scheme]
+	if !ok {
+		return nil, nil, ErrUnsupportedChannel
+	}
+	return uri, notifier, nil
 }
 
 func (s *Server) Start() {
 	for {
-		// Fetch pending callbacks from database
-		callbacks, err := database.FetchPendingCallbacks()
+		s.dispatch()
+
+		// Sleep until new callbacks are enqueued or retries become due
+		select {
+		case <-wakeup:
+		case <-time.After(30 * time.Second):
+		}
+	}
+}
+
+func (s *Server) dispatch() {
+	// Claim no more callbacks than there are idle workers, with headroom for busy hosts
+	idle := s.Workers - len(s.workers)
+	if idle < 1 {
+		return
+	}
+	callbacks, err := s.Database.ClaimPendingCallbacks(idle*4, 2*s.Timeout+time.Minute)
+	if err != nil {
+		return
+	}
+
+	for _, callback := range callbacks {
+		// Fetch the corresponding invoice from database
+		invoice, err := s.Database.FetchInvoiceById(callback.InvoiceId)
 		if err != nil {
-			time.Sleep(30 * time.Second)
+			s.failedCallbackRequest(callback, newCallbackAttempt(callback).WithError(err), s.RetryPolicy, 0)
 			continue
 		}
 
-		// Attempt delivering the callback
-		for _, callback := range callbacks {
-			s.sendCallbackRequest(callback)
+		// Resolve the destination, callbacks to removed or disabled webhook endpoints are abandoned
+		callbackUrl := invoice.CallbackUrl
+		var webhookEndpoint *database.WebhookEndpoint
+		if len(callback.WebhookId) > 0 {
+			endpoint, err := s.Database.FetchWebhookEndpointById(callback.WebhookId)
+			if err != nil {
+				s.abandonCallbackRequest(callback, newCallbackAttempt(callback).WithError(err))
+				continue
+			}
+			if !endpoint.Enabled {
+				s.abandonCallbackRequest(callback, newCallbackAttempt(callback).WithError(ErrWebhookDisabled))
+				continue
+			}
+			callbackUrl = endpoint.Url
+			webhookEndpoint = &endpoint
 		}
 
-		time.Sleep(30 * time.Second)
+		// Leave callbacks to busy hosts or beyond capacity for the next round
+		host := callbackHost(callbackUrl)
+		if !s.acquire(host) {
+			s.Database.ReleaseCallbackClaim(callback.Id)
+			continue
+		}
+
+		go func(callback database.Callback, invoice database.Invoice, webhookEndpoint *database.WebhookEndpoint) {
+			defer s.release(host)
+			s.sendCallbackRequest(callback, invoice, webhookEndpoint)
+		}(callback, invoice, webhookEndpoint)
+	}
+}
+
+func (s *Server) acquire(host string) bool {
+	s.hostsMu.Lock()
+	defer s.hostsMu.Unlock()
+
+	if s.hosts[host] >= s.HostConcurrency {
+		return false
+	}
+	select {
+	case s.workers <- struct{}{}:
+	default:
+		return false
+	}
+	s.hosts[host]++
+	return true
+}
+
+func (s *Server) release(host string) {
+	s.hostsMu.Lock()
+	s.hosts[host]--
+	if s.hosts[host] == 0 {
+		delete(s.hosts, host)
+	}
+	<-s.workers
+	s.hostsMu.Unlock()
+
+	notify()
+}
+
+func callbackHost(callbackUrl string) string {
+	uri, err := url.Parse(callbackUrl)
+	if err != nil {
+		return callbackUrl
+	}
+
+	// Email and AMQP share one relay or broker per channel
+	if uri.Scheme != "https" {
+		return uri.Scheme
+	}
+	return uri.Host
+}
+
+func notify() {
+	select {
+	case wakeup <- struct{}{}:
+	default:
 	}
 }
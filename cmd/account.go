@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"pkt-checkout/database"
+	"pkt-checkout/wallet"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+func createAccount(args []string) {
+	flags := flag.NewFlagSet("account create", flag.ExitOnError)
+	merchant := flags.String("merchant", "", "merchant name, up to 32 characters")
+	coldWallet := flags.String("cold-wallet", "", "PKT address payments are swept to")
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	flags.Parse(args)
+	readConfig()
+
+	// Validate arguments
+	if len(*merchant) < 1 || len(*merchant) > 32 {
+		log.Fatal().Msg("Account merchant must be 1 to 32 characters long")
+	}
+	if !wallet.IsPktAddress(*coldWallet) {
+		log.Fatal().Msg("Account cold wallet must be a PKT address")
+	}
+	store := startDatabase()
+	accounts, err := store.FetchAccounts()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Fetching accounts failed")
+	}
+	for _, other := range accounts {
+		if other.ColdWallet == *coldWallet {
+			log.Fatal().Uint32("accountId", other.Id).Msg("Account cold wallet already in use")
+		}
+	}
+
+	// Keys are only revealed now
+	account := database.NewAccount()
+	account.Merchant = *merchant
+	account.ColdWallet = *coldWallet
+	database.NewAccountKeys(&account)
+	err = store.InUnitOfWork(func(uow database.UnitOfWork) error {
+		if err := uow.SaveAccount(&account); err != nil {
+			return err
+		}
+		return database.SaveAccountKeys(uow, account)
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Creating account failed")
+	}
+
+	printAccountKeys(account, *asJSON)
+}
+
+func listAccounts(args []string) {
+	flags := flag.NewFlagSet("account list", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	flags.Parse(args)
+	readConfig()
+
+	store := startDatabase()
+	accounts, err := store.FetchAccounts()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Fetching accounts failed")
+	}
+	if accounts == nil {
+		accounts = []database.Account{}
+	}
+
+	// Secret keys stay sealed away
+	for j := range accounts {
+		accounts[j].SecretKey = ""
+	}
+
+	if *asJSON {
+		printJSON(accounts)
+		return
+	}
+	var rows [][]string
+	for _, account := range accounts {
+		rows = append(rows, []string{strconv.FormatUint(uint64(account.Id), 10),
+			account.Merchant,
+			account.ColdWallet,
+			strconv.FormatBool(account.Suspended),
+			strconv.Itoa(account.InvoiceMaxLifetime),
+			account.CallbackEvents})
+	}
+	printTable([]string{"ID", "MERCHANT", "COLD WALLET", "SUSPENDED", "MAX LIFETIME", "CALLBACK EVENTS"}, rows)
+}
+
+func rotateAccountKeys(args []string) {
+	flags := flag.NewFlagSet("account rotate-keys", flag.ExitOnError)
+	id := flags.Uint("id", 0, "account id")
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	flags.Parse(args)
+	readConfig()
+
+	store := startDatabase()
+	account, err := store.FetchAccountById(uint32(*id))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Fetching account failed")
+	}
+
+	// Revoke every key of the account, scoped ones included, and replace the
+	// secret key atomically
+	database.NewAccountKeys(&account)
+	err = store.InUnitOfWork(func(uow database.UnitOfWork) error {
+		apiKeys, err := uow.FetchApiKeysByAccountId(account.Id)
+		if err != nil {
+			return err
+		}
+		for j := range apiKeys {
+			if err := uow.RevokeApiKey(&apiKeys[j]); err != nil {
+				return err
+			}
+		}
+		if err := uow.UpdateAccountSecretKey(&account); err != nil {
+			return err
+		}
+		return database.SaveAccountKeys(uow, account)
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Rotating account keys failed")
+	}
+
+	printAccountKeys(account, *asJSON)
+}
+
+func printAccountKeys(account database.Account, asJSON bool) {
+	if asJSON {
+		printJSON(account)
+		return
+	}
+	printFields([][2]string{{"id", strconv.FormatUint(uint64(account.Id), 10)},
+		{"merchant", account.Merchant},
+		{"coldWallet", account.ColdWallet},
+		{"apiKey", account.ApiKey},
+		{"viewKey", account.ViewKey},
+		{"secretKey", account.SecretKey}})
+}
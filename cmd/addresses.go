@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"pkt-checkout/database"
+	"pkt-checkout/wallet"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// AddressPool summarizes the addresses invoices are assigned from
+type AddressPool struct {
+	Total     int                      `json:"total"`
+	InUse     int                      `json:"inUse"`
+	Available int                      `json:"available"`
+	Addresses []database.WalletAddress `json:"addresses"`
+}
+
+func showAddresses(args []string) {
+	flags := flag.NewFlagSet("addresses status", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	flags.Parse(args)
+	readConfig()
+
+	store := startDatabase()
+	addresses, err := store.FetchWalletAddressStates()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Fetching addresses failed")
+	}
+	pool := AddressPool{Total: len(addresses), Addresses: addresses}
+	if pool.Addresses == nil {
+		pool.Addresses = []database.WalletAddress{}
+	}
+	for _, address := range addresses {
+		if address.InUse {
+			pool.InUse++
+		}
+	}
+	pool.Available = pool.Total - pool.InUse
+
+	if *asJSON {
+		printJSON(pool)
+		return
+	}
+	printFields([][2]string{{"total", strconv.Itoa(pool.Total)},
+		{"inUse", strconv.Itoa(pool.InUse)},
+		{"available", strconv.Itoa(pool.Available)}})
+	if len(addresses) > 0 {
+		var rows [][]string
+		for _, address := range addresses {
+			rows = append(rows, []string{address.Address,
+				strconv.FormatBool(address.InUse),
+				formatTime(address.LastUsed)})
+		}
+		fmt.Println()
+		printTable([]string{"ADDRESS", "IN USE", "LAST USED"}, rows)
+	}
+}
+
+func generateAddresses(args []string) {
+	flags := flag.NewFlagSet("addresses generate", flag.ExitOnError)
+	count := flags.Int("count", 1, "number of addresses to add")
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	flags.Parse(args)
+	readConfig(walletConfigParams())
+	if *count < 1 {
+		log.Fatal().Msg("Address count must be positive")
+	}
+
+	store := startDatabase()
+	walletServer := wallet.NewServer(store)
+	addresses, err := walletServer.GenerateAddresses(*count)
+	if err != nil {
+		// Addresses generated until then remain in the pool
+		log.Error().Err(err).Int("generated", len(addresses)).Msg("Generating addresses failed")
+	}
+	if addresses == nil {
+		addresses = []string{}
+	}
+
+	if *asJSON {
+		printJSON(addresses)
+	} else {
+		var rows [][]string
+		for _, address := range addresses {
+			rows = append(rows, []string{address})
+		}
+		printTable([]string{"ADDRESS"}, rows)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"pkt-checkout/callback"
+	"pkt-checkout/database"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+func retryCallbacks(args []string) {
+	flags := flag.NewFlagSet("callbacks retry", flag.ExitOnError)
+	id := flags.String("id", "", "callback id, to retry a single callback")
+	accountId := flags.Uint("account", 0, "account id, to retry all failed callbacks of an account")
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	flags.Parse(args)
+	if (len(*id) > 0) == (*accountId > 0) {
+		log.Fatal().Msg("Either a callback id or an account id is required")
+	}
+	readConfig(callbackConfigParams())
+
+	store := startDatabase()
+	var callbacks []database.Callback
+	if len(*id) > 0 {
+		callback, err := store.FetchCallbackById(*id)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Fetching callback failed")
+		}
+
+		// Only dead-lettered callbacks may be requeued
+		if callback.Status != database.CallbackStatusFailed {
+			log.Fatal().Str("status", string(callback.Status)).Msg("Callback must have failed to be redelivered")
+		}
+		callbacks = append(callbacks, callback)
+	} else {
+		// Requeued callbacks leave the failed ones, run again for more
+		var err error
+		callbacks, err = store.FetchCallbacksByAccountId(uint32(*accountId), database.CallbackStatusFailed, 1000, 0)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Fetching callbacks failed")
+		}
+	}
+
+	// The running callback server delivers requeued callbacks on its next round
+	callbackServer := callback.NewServer(store)
+	requeued := []database.Callback{}
+	for _, callback := range callbacks {
+		if err := callbackServer.RequeueCallback(callback); err != nil {
+			log.Error().Err(err).Str("callbackId", callback.Id).Msg("Requeueing callback failed")
+			continue
+		}
+		callback.Status = database.CallbackStatusCreated
+		callback.ReqErrors = 0
+		requeued = append(requeued, callback)
+	}
+
+	if *asJSON {
+		printJSON(requeued)
+		return
+	}
+	printCallbacks(requeued)
+}
+
+func printCallbacks(callbacks []database.Callback) {
+	var rows [][]string
+	for _, callback := range callbacks {
+		rows = append(rows, []string{callback.Id,
+			callback.InvoiceId,
+			string(callback.Event),
+			string(callback.Status),
+			strconv.Itoa(callback.ReqErrors),
+			formatTime(callback.NextReqTime)})
+	}
+	printTable([]string{"CALLBACK", "INVOICE", "EVENT", "STATUS", "ERRORS", "NEXT REQUEST"}, rows)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"pkt-checkout/database"
+	"pkt-checkout/wallet"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// InvoiceDetails gathers everything recorded about an invoice
+type InvoiceDetails struct {
+	database.Invoice
+	Transactions []database.WalletTransaction `json:"transactions"`
+	History      []database.InvoiceHistory    `json:"history"`
+	Callbacks    []database.Callback          `json:"callbacks"`
+}
+
+func showInvoice(args []string) {
+	flags := flag.NewFlagSet("invoice show", flag.ExitOnError)
+	id := flags.String("id", "", "invoice id")
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	flags.Parse(args)
+	readConfig()
+
+	store := startDatabase()
+	invoice, err := store.FetchInvoiceById(*id)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Fetching invoice failed")
+	}
+	printInvoice(store, invoice, *asJSON)
+}
+
+func rescanInvoice(args []string) {
+	flags := flag.NewFlagSet("invoice rescan", flag.ExitOnError)
+	id := flags.String("id", "", "invoice id")
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	flags.Parse(args)
+	readConfig(walletConfigParams())
+
+	store := startDatabase()
+	walletServer := wallet.NewServer(store)
+	invoice, err := walletServer.Rescan(*id)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Rescanning invoice failed")
+	}
+	printInvoice(store, invoice, *asJSON)
+}
+
+func printInvoice(store database.Store, invoice database.Invoice, asJSON bool) {
+	details := InvoiceDetails{Invoice: invoice}
+	var err error
+	if details.Transactions, err = store.FetchWalletTransactionsByInvoiceId(invoice.Id); err != nil {
+		log.Fatal().Err(err).Msg("Fetching invoice transactions failed")
+	}
+	if details.History, err = store.FetchInvoiceHistoryByInvoiceId(invoice.Id); err != nil {
+		log.Fatal().Err(err).Msg("Fetching invoice history failed")
+	}
+	if details.Callbacks, err = store.FetchCallbacksByInvoiceId(invoice.Id); err != nil {
+		log.Fatal().Err(err).Msg("Fetching invoice callbacks failed")
+	}
+
+	if asJSON {
+		printJSON(details)
+		return
+	}
+	printFields([][2]string{{"id", invoice.Id},
+		{"clientId", invoice.ClientId},
+		{"accountId", strconv.FormatUint(uint64(invoice.AccountId), 10)},
+		{"status", string(invoice.Status)},
+		{"paymentAmount", strconv.FormatUint(invoice.PaymentAmount, 10)},
+		{"paymentAddress", invoice.PaymentAddress},
+		{"creationTime", formatTime(invoice.CreationTime)},
+		{"expirationTime", formatTime(invoice.ExpirationTime)}})
+
+	if len(details.Transactions) > 0 {
+		var rows [][]string
+		for _, tx := range details.Transactions {
+			rows = append(rows, []string{tx.Id,
+				strconv.FormatUint(tx.PaymentAmount, 10),
+				formatTime(tx.DiscoveryTime),
+				formatTime(tx.ConfirmationTime)})
+		}
+		fmt.Println()
+		printTable([]string{"TRANSACTION", "AMOUNT", "DISCOVERED", "CONFIRMED"}, rows)
+	}
+
+	if len(details.History) > 0 {
+		var rows [][]string
+		for _, entry := range details.History {
+			rows = append(rows, []string{string(entry.Action),
+				strconv.FormatUint(entry.PaymentAmount, 10),
+				formatTime(entry.ExpirationTime),
+				formatTime(entry.EventTime)})
+		}
+		fmt.Println()
+		printTable([]string{"ACTION", "AMOUNT", "EXPIRATION", "TIME"}, rows)
+	}
+
+	if len(details.Callbacks) > 0 {
+		fmt.Println()
+		printCallbacks(details.Callbacks)
+	}
+}
@@ -1,35 +1,86 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"os"
 	"pkt-checkout/api"
 	"pkt-checkout/callback"
 	"pkt-checkout/database"
+	"pkt-checkout/retention"
 	"pkt-checkout/wallet"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 )
 
-func requiredConfigParams() []string {
-	return []string{"api-http-address",
-		"api-http-port",
-		"mysql-address",
-		"mysql-port",
-		"mysql-database",
-		"mysql-user",
-		"mysql-pass",
-		"wallet-rpc-address",
+const usage = `Usage: main [command] [flags]
+
+Commands:
+  serve                  run the checkout servers (default)
+  migrate                apply pending database migrations, protect plaintext keys and exit
+  account create         create a merchant account
+  account list           list merchant accounts
+  account rotate-keys    replace the keys of an account, revoking the previous ones
+  invoice show           show an invoice with its transactions, history and callbacks
+  invoice rescan         scan the wallet backend for payments towards an invoice
+  addresses status       show the address pool
+  addresses generate     add new wallet backend addresses to the pool
+  callbacks retry        requeue failed callbacks
+  retention run          apply the retention policies once
+
+Run "main <command> -h" for the flags of a command.
+`
+
+// command runs a subcommand with the arguments following its name
+type command func(args []string)
+
+var commands = map[string]command{
+	"serve":               serve,
+	"migrate":             migrateDatabase,
+	"account create":      createAccount,
+	"account list":        listAccounts,
+	"account rotate-keys": rotateAccountKeys,
+	"invoice show":        showInvoice,
+	"invoice rescan":      rescanInvoice,
+	"addresses status":    showAddresses,
+	"addresses generate":  generateAddresses,
+	"callbacks retry":     retryCallbacks,
+	"retention run":       runRetention,
+}
+
+func databaseConfigParams() []string {
+	// Only MySQL and PostgreSQL require connection details
+	switch viper.GetString("database-backend") {
+	case "", "mysql":
+		return []string{"mysql-address", "mysql-port", "mysql-database", "mysql-user", "mysql-pass"}
+	case "postgres":
+		return []string{"postgres-address", "postgres-database", "postgres-user", "postgres-pass"}
+	}
+	return nil
+}
+
+func walletConfigParams() []string {
+	return []string{"wallet-rpc-address",
 		"wallet-rpc-port",
 		"wallet-rpc-user",
 		"wallet-rpc-pass",
 		"wallet-addresses",
-		"wallet-confirmations",
-		"callback-attempts",
+		"wallet-confirmations"}
+}
+
+func callbackConfigParams() []string {
+	return []string{"callback-attempts",
 		"callback-backoff"}
 }
 
-func main() {
+func apiConfigParams() []string {
+	return []string{"api-http-address",
+		"api-http-port"}
+}
+
+func readConfig(params ...[]string) {
 	// Read configuration
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
@@ -39,28 +90,96 @@ func main() {
 	}
 
 	// Lazy-validate configuration
-	for _, key := range requiredConfigParams() {
-		if !viper.IsSet(key) {
-			log.Fatal().Str("error", fmt.Sprintf("missing configuration key: %s", key)).Msg("Interpreting configuration file failed")
+	params = append(params, databaseConfigParams())
+	for _, keys := range params {
+		for _, key := range keys {
+			if !viper.IsSet(key) {
+				log.Fatal().Str("error", fmt.Sprintf("missing configuration key: %s", key)).Msg("Interpreting configuration file failed")
+			}
 		}
 	}
+}
+
+func main() {
+	// Without a command the servers run, as they did before there were commands
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		serve(os.Args[1:])
+		return
+	}
 
-	// Start the database server
+	// Commands are one or two words long
+	name := os.Args[1]
+	args := os.Args[2:]
+	if _, ok := commands[name]; !ok && len(args) > 0 {
+		name = name + " " + args[0]
+		args = args[1:]
+	}
+	run, ok := commands[name]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	run(args)
+}
+
+func serve(args []string) {
+	// Parse command line
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	migrateOnly := flags.Bool("migrate", false, "apply pending database migrations, protect plaintext keys and exit")
+	flags.Parse(args)
+	if *migrateOnly {
+		migrateDatabase(nil)
+		return
+	}
+
+	readConfig(apiConfigParams(), walletConfigParams(), callbackConfigParams())
+
+	// Start the database server, the database may still be coming up
 	databaseServer := database.NewServer()
 	databaseServer.Start()
+	walletServer := wallet.NewServer(databaseServer.Store)
+	callbackServer := callback.NewServer(databaseServer.Store)
+	retentionServer := retention.NewServer(databaseServer.Store)
+
+	// Start the API server, answering 503 until the database is ready
+	apiServer := api.NewServer(databaseServer.Store, callbackServer)
+	go apiServer.Start()
+	<-databaseServer.Ready()
 
 	// Start the wallet server
-	walletServer := wallet.NewServer()
 	go walletServer.Start()
 
 	// Start the callback server
-	callbackServer := callback.NewServer()
 	go callbackServer.Start()
 
-	// Start the API server
-	apiServer := api.NewServer()
-	go apiServer.Start()
+	// Start the retention server, unless all records are kept
+	if retentionServer.Enabled() {
+		go retentionServer.Start()
+	}
 
 	// Run forever
 	<-make(chan int)
 }
+
+func migrateDatabase(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.Parse(args)
+	readConfig()
+
+	databaseServer := database.NewServer()
+	databaseServer.Migrate = true
+	databaseServer.Start()
+	<-databaseServer.Ready()
+	log.Info().Msg("Database scheme is up to date")
+}
+
+// startDatabase connects to an up to date database for the administration
+// commands, they neither migrate nor wait for the database to come up
+func startDatabase() database.Store {
+	databaseServer := database.NewServer()
+	databaseServer.Migrate = false
+	databaseServer.ConnectAttempts = 1
+	databaseServer.Start()
+	<-databaseServer.Ready()
+	return databaseServer.Store
+}
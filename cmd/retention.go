@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"pkt-checkout/retention"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+func runRetention(args []string) {
+	flags := flag.NewFlagSet("retention run", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would be removed without removing anything")
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	flags.Parse(args)
+	readConfig()
+
+	store := startDatabase()
+	retentionServer := retention.NewServer(store)
+	if !retentionServer.Enabled() {
+		log.Fatal().Msg("No retention policy configured")
+	}
+	retentionServer.DryRun = retentionServer.DryRun || *dryRun
+
+	report, err := retentionServer.Run(time.Now())
+	if err != nil {
+		// Records removed until then are reported all the same
+		log.Error().Err(err).Msg("Applying retention policies failed")
+	}
+
+	if *asJSON {
+		printJSON(report)
+	} else {
+		printFields([][2]string{{"dryRun", strconv.FormatBool(report.DryRun)},
+			{"purgedInvoices", strconv.Itoa(report.PurgedInvoices)},
+			{"archivedInvoices", strconv.Itoa(report.ArchivedInvoices)},
+			{"purgedCallbacks", strconv.Itoa(report.PurgedCallbacks)},
+			{"archive", report.Archive}})
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
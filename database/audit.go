@@ -0,0 +1,70 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+const auditAppendAttempts = 5
+
+// Sizes of the auditLog columns holding request derived text
+const (
+	auditActorLimit  = 64
+	auditActionLimit = 64
+	auditTargetLimit = 255
+	auditIpLimit     = 45
+)
+
+// AuditVerification is the outcome of walking the audit log hash chain
+type AuditVerification struct {
+	Verified       bool   `json:"verified"`
+	Entries        uint64 `json:"entries"`
+	HeadHash       string `json:"headHash"`
+	BrokenSequence uint64 `json:"brokenSequence,omitempty"`
+}
+
+// ComputeHash digests the entry along with the hash of its predecessor, so
+// changing, removing or reordering any entry breaks every later hash
+func (e *AuditEntry) ComputeHash() string {
+	digest := sha256.Sum256([]byte(fmt.Sprintf("%d|%s|%s|%d|%s|%s|%s|%d|%s",
+		e.Sequence,
+		e.EventTime.UTC().Format(time.RFC3339),
+		e.Actor,
+		e.AccountId,
+		e.Action,
+		e.Target,
+		e.Ip,
+		e.Outcome,
+		e.PrevHash)))
+	return hex.EncodeToString(digest[:])
+}
+
+// VerifyAuditLog recomputes the hash chain from the first entry. Entries cut
+// off the end leave a valid chain, compare the head hash with one recorded
+// elsewhere to detect that.
+func VerifyAuditLog(repositories Repositories) (AuditVerification, error) {
+	var verification AuditVerification
+	var sequence uint64
+	for {
+		entries, err := repositories.FetchAuditEntriesAfter(sequence, 1000)
+		if err != nil {
+			return verification, err
+		}
+		if len(entries) == 0 {
+			verification.Verified = true
+			return verification, nil
+		}
+
+		for _, entry := range entries {
+			if entry.Sequence != sequence+1 || entry.PrevHash != verification.HeadHash || entry.Hash != entry.ComputeHash() {
+				verification.BrokenSequence = sequence + 1
+				return verification, nil
+			}
+			sequence = entry.Sequence
+			verification.Entries++
+			verification.HeadHash = entry.Hash
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Sequence numbers are assigned per invoice and destination in order of
+// creation. MySQL refuses subqueries on the table inserted into, PostgreSQL
+// types parameters selected without a table column as text.
+const (
+	callbackInsertSelect = "INSERT INTO callbacks (id, invoiceId, webhookId, event, requestTime, nextReqTime, reqErrors, status, sequence) SELECT ?, ?, ?, ?, ?, ?, ?, ?, COALESCE(MAX(sequence), 0) + 1 FROM callbacks WHERE invoiceId = ? AND webhookId = ?"
+	callbackInsertValues = "INSERT INTO callbacks (id, invoiceId, webhookId, event, requestTime, nextReqTime, reqErrors, status, sequence) VALUES (?, ?, ?, ?, ?, ?, ?, ?, (SELECT COALESCE(MAX(sequence), 0) + 1 FROM callbacks WHERE invoiceId = ? AND webhookId = ?))"
+)
+
+// dialect covers the differences between the supported database backends
+type dialect struct {
+	name                string
+	driver              string
+	forUpdate           string
+	forUpdateSkipLocked string
+	callbackInsert      string
+	utcTimes            bool
+	numberedParameters  bool
+	returningIds        bool
+
+	// Migrations
+	migrationsLock   string
+	migrationsUnlock string
+	migrationsTable  string
+	tableExists      string
+	columnExists     string
+	transactionalDdl bool
+}
+
+var mysqlDialect = dialect{
+	name:                "mysql",
+	driver:              "mysql",
+	forUpdate:           " FOR UPDATE",
+	forUpdateSkipLocked: " FOR UPDATE SKIP LOCKED",
+	callbackInsert:      callbackInsertSelect,
+	migrationsLock:      "SELECT GET_LOCK('pkt-checkout-migrations', 60)",
+	migrationsUnlock:    "DO RELEASE_LOCK('pkt-checkout-migrations')",
+	migrationsTable:     "CREATE TABLE IF NOT EXISTS `schemaMigrations` (`version` int(11) NOT NULL PRIMARY KEY, `name` varchar(64) NOT NULL, `checksum` char(64) NOT NULL, `appliedTime` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci",
+	tableExists:         "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?",
+	columnExists:        "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?",
+}
+
+// SQLite serializes writers on its own, transactions begin immediately
+// instead of locking rows. Times are stored as text and compared as such,
+// so they are always stored in UTC.
+var sqliteDialect = dialect{
+	name:             "sqlite",
+	driver:           "sqlite3",
+	callbackInsert:   callbackInsertSelect,
+	utcTimes:         true,
+	migrationsTable:  "CREATE TABLE IF NOT EXISTS `schemaMigrations` (`version` INTEGER NOT NULL PRIMARY KEY, `name` TEXT NOT NULL, `checksum` TEXT NOT NULL, `appliedTime` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP)",
+	tableExists:      "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?",
+	columnExists:     "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?",
+	transactionalDdl: true,
+}
+
+// PostgreSQL folds the unquoted camel case identifiers of the queries to lower
+// case, as it does for the ones in its migrations. Its driver reports no last
+// insert ids, they are returned by the inserts instead.
+var postgresDialect = dialect{
+	name:                "postgres",
+	driver:              "postgres",
+	forUpdate:           " FOR UPDATE",
+	forUpdateSkipLocked: " FOR UPDATE SKIP LOCKED",
+	callbackInsert:      callbackInsertValues,
+	numberedParameters:  true,
+	returningIds:        true,
+	migrationsLock:      "SELECT COUNT(*) FROM (SELECT pg_advisory_lock(7034561)) AS locked",
+	migrationsUnlock:    "SELECT pg_advisory_unlock(7034561)",
+	migrationsTable:     "CREATE TABLE IF NOT EXISTS schemaMigrations (version integer NOT NULL PRIMARY KEY, name varchar(64) NOT NULL, checksum char(64) NOT NULL, appliedTime timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP)",
+	tableExists:         "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = lower(?)",
+	columnExists:        "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = lower(?) AND column_name = lower(?)",
+	transactionalDdl:    true,
+}
+
+func (d *dialect) bind(query string, args []any) (string, []any) {
+	if d.utcTimes {
+		for k, arg := range args {
+			switch t := arg.(type) {
+			case time.Time:
+				args[k] = t.UTC()
+			case sql.NullTime:
+				t.Time = t.Time.UTC()
+				args[k] = t
+			}
+		}
+	}
+	if d.numberedParameters {
+		query = numberParameters(query)
+	}
+	return query, args
+}
+
+// numberParameters replaces ? placeholders outside of string literals by $1, $2, ...
+func numberParameters(query string) string {
+	var numbered strings.Builder
+	parameter := 0
+	quoted := false
+	for _, r := range query {
+		if r == '\'' {
+			quoted = !quoted
+		}
+		if r == '?' && !quoted {
+			parameter++
+			numbered.WriteString("$" + strconv.Itoa(parameter))
+			continue
+		}
+		numbered.WriteRune(r)
+	}
+	return numbered.String()
+}
+
+// boundExecutor applies the dialect to every statement
+type boundExecutor struct {
+	executor
+	dialect *dialect
+}
+
+func (e boundExecutor) Exec(query string, args ...any) (sql.Result, error) {
+	query, args = e.dialect.bind(query, args)
+	return e.executor.Exec(query, args...)
+}
+
+func (e boundExecutor) Query(query string, args ...any) (*sql.Rows, error) {
+	query, args = e.dialect.bind(query, args)
+	return e.executor.Query(query, args...)
+}
+
+func (e boundExecutor) QueryRow(query string, args ...any) *sql.Row {
+	query, args = e.dialect.bind(query, args)
+	return e.executor.QueryRow(query, args...)
+}
+
+// isUniqueViolation reports whether err is a duplicate key error of any of
+// the backends
+func isUniqueViolation(err error) bool {
+	var mysqlError *mysql.MySQLError
+	if errors.As(err, &mysqlError) {
+		return mysqlError.Number == 1062
+	}
+	var postgresError *pq.Error
+	if errors.As(err, &postgresError) {
+		return postgresError.Code == "23505"
+	}
+	var sqliteError sqlite3.Error
+	if errors.As(err, &sqliteError) {
+		return sqliteError.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteError.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return false
+}
@@ -0,0 +1,9 @@
+package database
+
+import "testing"
+
+// NewTestStore opens a migrated SQLite store for the external tests of this
+// directory, which exercise the packages built on top of the store
+func NewTestStore(t *testing.T) Store {
+	return newTestStore(t)
+}
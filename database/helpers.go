@@ -1,44 +1,254 @@
 package database
 
-func FetchAccountById(id uint32) (Account, error) {
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrInsufficientWalletAddresses = errors.New("insufficient wallet addresses available")
+	ErrInvoiceNotPending           = errors.New("invoice is no longer awaiting payment")
+	ErrInvoiceStatusChanged        = errors.New("invoice status changed concurrently")
+	ErrInvoiceClientIdInUse        = errors.New("invoice client ID already in use")
+	ErrAccountNotSuspended         = errors.New("account must be suspended before deletion")
+	ErrAccountHasPendingInvoices   = errors.New("account has invoices awaiting payment")
+)
+
+func (r *sqlRepository) FetchAccountById(id uint32) (Account, error) {
 	var account Account
-	dbConnection := GetConnection()
-	if err := dbConnection.QueryRow("SELECT id, merchant, apiKey, viewKey, secretKey, coldWallet FROM accounts WHERE id = ?", id).Scan(&account.Id, &account.Merchant, &account.ApiKey, &account.ViewKey, &account.SecretKey, &account.ColdWallet); err != nil {
+	dbConnection := r.connection()
+	if err := dbConnection.QueryRow("SELECT id, merchant, secretKey, coldWallet, suspended, uniqueClientId, invoiceExtensions, invoiceMaxLifetime, callbackEvents, callbackRetryPolicy, callbackAcknowledgement FROM accounts WHERE id = ?", id).Scan(&account.Id, &account.Merchant, &account.SecretKey, &account.ColdWallet, &account.Suspended, &account.UniqueClientId, &account.InvoiceExtensions, &account.InvoiceMaxLifetime, &account.CallbackEvents, &account.CallbackRetryPolicy, &account.CallbackAcknowledgement); err != nil {
 		return account, err
 	}
-	return account, nil
+	return r.openAccount(account)
 }
 
-func FetchAccountByApiKey(apiKey string) (Account, error) {
-	var account Account
-	dbConnection := GetConnection()
-	if err := dbConnection.QueryRow("SELECT id, merchant, apiKey, viewKey, secretKey, coldWallet FROM accounts WHERE apiKey = ?", apiKey).Scan(&account.Id, &account.Merchant, &account.ApiKey, &account.ViewKey, &account.SecretKey, &account.ColdWallet); err != nil {
-		return account, err
+// LockAccount holds the account's row until the unit of work ends, so checks
+// spanning the account's invoices run one at a time. SQLite serializes whole
+// transactions instead.
+func (r *sqlRepository) LockAccount(id uint32) error {
+	var lockedId uint32
+	dbConnection := r.connection()
+	return dbConnection.QueryRow("SELECT id FROM accounts WHERE id = ?"+r.dialect.forUpdate, id).Scan(&lockedId)
+}
+
+func (r *sqlRepository) FetchAccounts() ([]Account, error) {
+	var accounts []Account
+	dbConnection := r.connection()
+	rows, err := dbConnection.Query("SELECT id, merchant, secretKey, coldWallet, suspended, uniqueClientId, invoiceExtensions, invoiceMaxLifetime, callbackEvents, callbackRetryPolicy, callbackAcknowledgement FROM accounts ORDER BY id ASC")
+	if err != nil {
+		return nil, err
 	}
-	return account, nil
+	defer rows.Close()
+
+	for rows.Next() {
+		var account Account
+		rows.Scan(&account.Id, &account.Merchant, &account.SecretKey, &account.ColdWallet, &account.Suspended, &account.UniqueClientId, &account.InvoiceExtensions, &account.InvoiceMaxLifetime, &account.CallbackEvents, &account.CallbackRetryPolicy, &account.CallbackAcknowledgement)
+		if account, err = r.openAccount(account); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+
+	return accounts, nil
 }
 
-func FetchAccountByViewKey(viewKey string) (Account, error) {
-	var account Account
-	dbConnection := GetConnection()
-	if err := dbConnection.QueryRow("SELECT id, merchant, apiKey, viewKey, secretKey, coldWallet FROM accounts WHERE viewKey = ?", viewKey).Scan(&account.Id, &account.Merchant, &account.ApiKey, &account.ViewKey, &account.SecretKey, &account.ColdWallet); err != nil {
-		return account, err
+// FetchActiveApiKey looks up the candidates sharing the key's prefix and
+// compares their hashes, keys themselves are not stored
+func (r *sqlRepository) FetchActiveApiKey(key string) (ApiKey, error) {
+	if len(key) < KeyPrefixLength {
+		return ApiKey{}, sql.ErrNoRows
+	}
+
+	dbConnection := r.connection()
+	now := time.Now()
+	rows, err := dbConnection.Query("SELECT id, accountId, label, prefix, hash, scopes, secretKey, creationTime, expirationTime, lastUsedTime, revocationTime FROM apiKeys WHERE prefix = ? AND revocationTime IS NULL AND (expirationTime IS NULL OR expirationTime > ?)", KeyPrefix(key), now)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var apiKey ApiKey
+		var hash string
+		if err := rows.Scan(&apiKey.Id, &apiKey.AccountId, &apiKey.Label, &apiKey.Prefix, &hash, &apiKey.Scopes, &apiKey.SecretKey, &apiKey.CreationTime, &apiKey.ExpirationTime, &apiKey.LastUsedTime, &apiKey.RevocationTime); err != nil {
+			return ApiKey{}, err
+		}
+		if !keyMatches(key, hash) {
+			continue
+		}
+		if len(apiKey.SecretKey) > 0 {
+			if apiKey.SecretKey, err = r.envelope.open(apiKey.SecretKey); err != nil {
+				return ApiKey{}, err
+			}
+		}
+		return apiKey, nil
 	}
+	if err := rows.Err(); err != nil {
+		return ApiKey{}, err
+	}
+
+	return ApiKey{}, sql.ErrNoRows
+}
+
+func (r *sqlRepository) FetchApiKeyById(id string) (ApiKey, error) {
+	var apiKey ApiKey
+	dbConnection := r.connection()
+	if err := dbConnection.QueryRow("SELECT id, accountId, label, prefix, scopes, creationTime, expirationTime, lastUsedTime, revocationTime FROM apiKeys WHERE id = ?", id).Scan(&apiKey.Id, &apiKey.AccountId, &apiKey.Label, &apiKey.Prefix, &apiKey.Scopes, &apiKey.CreationTime, &apiKey.ExpirationTime, &apiKey.LastUsedTime, &apiKey.RevocationTime); err != nil {
+		return apiKey, err
+	}
+	return apiKey, nil
+}
+
+func (r *sqlRepository) FetchApiKeysByAccountId(accountId uint32) ([]ApiKey, error) {
+	var apiKeys []ApiKey
+	dbConnection := r.connection()
+	rows, err := dbConnection.Query("SELECT id, accountId, label, prefix, scopes, creationTime, expirationTime, lastUsedTime, revocationTime FROM apiKeys WHERE accountId = ? ORDER BY creationTime ASC", accountId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var apiKey ApiKey
+		rows.Scan(&apiKey.Id, &apiKey.AccountId, &apiKey.Label, &apiKey.Prefix, &apiKey.Scopes, &apiKey.CreationTime, &apiKey.ExpirationTime, &apiKey.LastUsedTime, &apiKey.RevocationTime)
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	return apiKeys, nil
+}
+
+func (r *sqlRepository) openAccount(account Account) (Account, error) {
+	secretKey, err := r.envelope.open(account.SecretKey)
+	if err != nil {
+		return Account{}, err
+	}
+	account.SecretKey = secretKey
 	return account, nil
 }
 
-func FetchInvoiceById(id string) (Invoice, error) {
+func (r *sqlRepository) FetchActiveCallbackSecrets(accountId uint32) ([]CallbackSecret, error) {
+	return r.fetchActiveCallbackSecrets("accountId = ? AND webhookId = ''", accountId)
+}
+
+// FetchActiveWebhookSecrets returns the previous secrets of a webhook
+// endpoint still signing alongside its current one
+func (r *sqlRepository) FetchActiveWebhookSecrets(webhookId string) ([]CallbackSecret, error) {
+	return r.fetchActiveCallbackSecrets("webhookId = ?", webhookId)
+}
+
+func (r *sqlRepository) fetchActiveCallbackSecrets(owner string, ownerId any) ([]CallbackSecret, error) {
+	var callbackSecrets []CallbackSecret
+	dbConnection := r.connection()
+	rows, err := dbConnection.Query("SELECT id, accountId, webhookId, secret, creationTime, expirationTime FROM callbackSecrets WHERE "+owner+" AND (expirationTime IS NULL OR expirationTime > ?) ORDER BY creationTime DESC", ownerId, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var callbackSecret CallbackSecret
+		rows.Scan(&callbackSecret.Id, &callbackSecret.AccountId, &callbackSecret.WebhookId, &callbackSecret.Secret, &callbackSecret.CreationTime, &callbackSecret.ExpirationTime)
+		if callbackSecret.Secret, err = r.envelope.open(callbackSecret.Secret); err != nil {
+			return nil, err
+		}
+		callbackSecrets = append(callbackSecrets, callbackSecret)
+	}
+
+	return callbackSecrets, nil
+}
+
+func (r *sqlRepository) ExpireCallbackSecrets(accountId uint32, expirationTime time.Time) error {
+	dbConnection := r.connection()
+
+	// Shorten the lifetime of all active secrets
+	if _, err := dbConnection.Exec("UPDATE callbackSecrets SET expirationTime = ? WHERE accountId = ? AND webhookId = '' AND (expirationTime IS NULL OR expirationTime > ?)", expirationTime, accountId, expirationTime); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *sqlRepository) ExpireWebhookSecrets(webhookId string, expirationTime time.Time) error {
+	dbConnection := r.connection()
+
+	// Shorten the lifetime of all previous secrets
+	if _, err := dbConnection.Exec("UPDATE callbackSecrets SET expirationTime = ? WHERE webhookId = ? AND (expirationTime IS NULL OR expirationTime > ?)", expirationTime, webhookId, expirationTime); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *sqlRepository) FetchWebhookEndpointById(id string) (WebhookEndpoint, error) {
+	var webhookEndpoint WebhookEndpoint
+	dbConnection := r.connection()
+	if err := dbConnection.QueryRow("SELECT id, accountId, url, events, secret, enabled, creationTime FROM webhookEndpoints WHERE id = ?", id).Scan(&webhookEndpoint.Id, &webhookEndpoint.AccountId, &webhookEndpoint.Url, &webhookEndpoint.Events, &webhookEndpoint.Secret, &webhookEndpoint.Enabled, &webhookEndpoint.CreationTime); err != nil {
+		return webhookEndpoint, err
+	}
+	secret, err := r.envelope.open(webhookEndpoint.Secret)
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+	webhookEndpoint.Secret = secret
+	return webhookEndpoint, nil
+}
+
+func (r *sqlRepository) FetchWebhookEndpointsByAccountId(accountId uint32) ([]WebhookEndpoint, error) {
+	var webhookEndpoints []WebhookEndpoint
+	dbConnection := r.connection()
+	rows, err := dbConnection.Query("SELECT id, accountId, url, events, secret, enabled, creationTime FROM webhookEndpoints WHERE accountId = ? ORDER BY creationTime ASC", accountId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var webhookEndpoint WebhookEndpoint
+		rows.Scan(&webhookEndpoint.Id, &webhookEndpoint.AccountId, &webhookEndpoint.Url, &webhookEndpoint.Events, &webhookEndpoint.Secret, &webhookEndpoint.Enabled, &webhookEndpoint.CreationTime)
+		if webhookEndpoint.Secret, err = r.envelope.open(webhookEndpoint.Secret); err != nil {
+			return nil, err
+		}
+		webhookEndpoints = append(webhookEndpoints, webhookEndpoint)
+	}
+
+	return webhookEndpoints, nil
+}
+
+func (r *sqlRepository) FetchInvoiceById(id string) (Invoice, error) {
 	var invoice Invoice
-	dbConnection := GetConnection()
+	dbConnection := r.connection()
 	if err := dbConnection.QueryRow("SELECT id, clientId, accountId, paymentAmount, paymentAddress, paymentDescription, callbackUrl, creationTime, expirationTime, status FROM invoices WHERE id = ?", id).Scan(&invoice.Id, &invoice.ClientId, &invoice.AccountId, &invoice.PaymentAmount, &invoice.PaymentAddress, &invoice.PaymentDescription, &invoice.CallbackUrl, &invoice.CreationTime, &invoice.ExpirationTime, &invoice.Status); err != nil {
 		return invoice, err
 	}
 	return invoice, nil
 }
 
-func FetchPendingInvoices() ([]Invoice, error) {
+// LockInvoice fetches the invoice and holds its row until the unit of work
+// ends, so checks spanning its history run one at a time. SQLite serializes
+// whole transactions instead.
+func (r *sqlRepository) LockInvoice(id string) (Invoice, error) {
+	var invoice Invoice
+	dbConnection := r.connection()
+	if err := dbConnection.QueryRow("SELECT id, clientId, accountId, paymentAmount, paymentAddress, paymentDescription, callbackUrl, creationTime, expirationTime, status FROM invoices WHERE id = ?"+r.dialect.forUpdate, id).Scan(&invoice.Id, &invoice.ClientId, &invoice.AccountId, &invoice.PaymentAmount, &invoice.PaymentAddress, &invoice.PaymentDescription, &invoice.CallbackUrl, &invoice.CreationTime, &invoice.ExpirationTime, &invoice.Status); err != nil {
+		return invoice, err
+	}
+	return invoice, nil
+}
+
+func (r *sqlRepository) FetchInvoiceByClientId(accountId uint32, clientId string) (Invoice, error) {
+	var invoice Invoice
+	dbConnection := r.connection()
+	if err := dbConnection.QueryRow("SELECT id, clientId, accountId, paymentAmount, paymentAddress, paymentDescription, callbackUrl, creationTime, expirationTime, status FROM invoices WHERE accountId = ? AND clientId = ? ORDER BY creationTime DESC LIMIT 1", accountId, clientId).Scan(&invoice.Id, &invoice.ClientId, &invoice.AccountId, &invoice.PaymentAmount, &invoice.PaymentAddress, &invoice.PaymentDescription, &invoice.CallbackUrl, &invoice.CreationTime, &invoice.ExpirationTime, &invoice.Status); err != nil {
+		return invoice, err
+	}
+	return invoice, nil
+}
+
+func (r *sqlRepository) FetchPendingInvoices() ([]Invoice, error) {
 	var invoices []Invoice
-	dbConnection := GetConnection()
+	dbConnection := r.connection()
 	rows, err := dbConnection.Query("SELECT id, clientId, accountId, paymentAmount, paymentAddress, paymentDescription, callbackUrl, creationTime, expirationTime, status FROM invoices WHERE status IN (?, ?)", InvoiceStatusCreated, InvoiceStatusPending)
 	if err != nil {
 		return nil, err
@@ -53,48 +263,135 @@ func FetchPendingInvoices() ([]Invoice, error) {
 	return invoices, nil
 }
 
-func FetchLRUWalletAddress() (string, error) {
-	dbConnection := GetConnection()
+func (r *sqlRepository) FetchSettledInvoicesBefore(status InvoiceStatus, before time.Time, limit int, offset int) ([]Invoice, error) {
+	var invoices []Invoice
+	dbConnection := r.connection()
 
-	// Safety
-	dbTx, err := dbConnection.Begin()
+	// Invoices still calling back stay until delivery is settled
+	rows, err := dbConnection.Query("SELECT id, clientId, accountId, paymentAmount, paymentAddress, paymentDescription, callbackUrl, creationTime, expirationTime, status FROM invoices i WHERE status = ? AND expirationTime < ? AND NOT EXISTS (SELECT 1 FROM callbacks c WHERE c.invoiceId = i.id AND c.status = ?) ORDER BY expirationTime ASC LIMIT ? OFFSET ?", status, before, CallbackStatusCreated, limit, offset)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	defer rows.Close()
 
-	// Fetch LRU address
-	var address string
-	if err := dbTx.QueryRow("SELECT address FROM walletAddresses WHERE inUse = 0 ORDER BY lastUsed ASC LIMIT 1 FOR UPDATE").Scan(&address); err != nil {
-		dbTx.Rollback()
-		return "", err
+	for rows.Next() {
+		var invoice Invoice
+		rows.Scan(&invoice.Id, &invoice.ClientId, &invoice.AccountId, &invoice.PaymentAmount, &invoice.PaymentAddress, &invoice.PaymentDescription, &invoice.CallbackUrl, &invoice.CreationTime, &invoice.ExpirationTime, &invoice.Status)
+		invoices = append(invoices, invoice)
 	}
 
-	// Lock LRU address
-	if _, err := dbTx.Exec("UPDATE walletAddresses SET inUse = 1, lastUsed = NOW() WHERE address = ?", address); err != nil {
-		dbTx.Rollback()
+	return invoices, nil
+}
+
+func (r *sqlRepository) FetchPendingInvoiceCountByAccountId(accountId uint32) (int, error) {
+	var count int
+	dbConnection := r.connection()
+	if err := dbConnection.QueryRow("SELECT COUNT(*) FROM invoices WHERE accountId = ? AND status IN (?, ?)", accountId, InvoiceStatusCreated, InvoiceStatusPending).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (r *sqlRepository) FetchLRUWalletAddress() (string, error) {
+	addresses, err := r.FetchLRUWalletAddresses(1)
+	if err == ErrInsufficientWalletAddresses {
+		return "", sql.ErrNoRows
+	}
+	if err != nil {
 		return "", err
 	}
+	return addresses[0], nil
+}
+
+func (r *sqlRepository) FetchLRUWalletAddresses(count int) ([]string, error) {
+	var addresses []string
+	err := r.transact(func(dbTx executor) error {
+		// Fetch LRU addresses
+		rows, err := dbTx.Query("SELECT address FROM walletAddresses WHERE inUse = ? ORDER BY lastUsed ASC LIMIT ?"+r.dialect.forUpdate, false, count)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var address string
+			if err := rows.Scan(&address); err != nil {
+				rows.Close()
+				return err
+			}
+			addresses = append(addresses, address)
+		}
+		rows.Close()
 
-	// Persist
-	dbTx.Commit()
+		// All or nothing
+		if len(addresses) < count {
+			return ErrInsufficientWalletAddresses
+		}
 
-	return address, nil
+		// Lock LRU addresses
+		for _, address := range addresses {
+			if _, err := dbTx.Exec("UPDATE walletAddresses SET inUse = ?, lastUsed = ? WHERE address = ?", true, time.Now(), address); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return addresses, nil
 }
 
-func ReleaseLRUWalletAddress(address string) error {
-	dbConnection := GetConnection()
+func (r *sqlRepository) ReleaseLRUWalletAddress(address string) error {
+	dbConnection := r.connection()
 
-	// Release LRU address
-	if _, err := dbConnection.Exec("UPDATE walletAddresses SET inUse = 0, lastUsed = NOW() WHERE address = ?", address); err != nil {
+	// Release LRU address, unless an invoice awaiting payment still uses it
+	if _, err := dbConnection.Exec("UPDATE walletAddresses SET inUse = ?, lastUsed = ? WHERE address = ? AND NOT EXISTS (SELECT 1 FROM invoices WHERE paymentAddress = ? AND status IN (?, ?))", false, time.Now(), address, address, InvoiceStatusCreated, InvoiceStatusPending); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func FetchWalletTransactionsByInvoiceId(invoiceId string) ([]WalletTransaction, error) {
+func (r *sqlRepository) FetchWalletAddresses() ([]string, error) {
+	var addresses []string
+	dbConnection := r.connection()
+	rows, err := dbConnection.Query("SELECT address FROM walletAddresses")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var address string
+		rows.Scan(&address)
+		addresses = append(addresses, address)
+	}
+
+	return addresses, nil
+}
+
+func (r *sqlRepository) FetchWalletAddressStates() ([]WalletAddress, error) {
+	var walletAddresses []WalletAddress
+	dbConnection := r.connection()
+	rows, err := dbConnection.Query("SELECT address, lastUsed, inUse FROM walletAddresses ORDER BY lastUsed ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var walletAddress WalletAddress
+		rows.Scan(&walletAddress.Address, &walletAddress.LastUsed, &walletAddress.InUse)
+		walletAddresses = append(walletAddresses, walletAddress)
+	}
+
+	return walletAddresses, nil
+}
+
+func (r *sqlRepository) FetchWalletTransactionsByInvoiceId(invoiceId string) ([]WalletTransaction, error) {
 	var walletTransactions []WalletTransaction
-	dbConnection := GetConnection()
+	dbConnection := r.connection()
 	rows, err := dbConnection.Query("SELECT id, invoiceId, walletAddress, paymentAmount, confirmationTime, discoveryTime FROM walletTransactions WHERE invoiceId = ?", invoiceId)
 	if err != nil {
 		return nil, err
@@ -109,28 +406,231 @@ func FetchWalletTransactionsByInvoiceId(invoiceId string) ([]WalletTransaction,
 	return walletTransactions, nil
 }
 
-func FetchPaymentAmountSumForInvoiceId(invoiceId string) (uint64, error) {
+func (r *sqlRepository) FetchInvoiceHistoryByInvoiceId(invoiceId string) ([]InvoiceHistory, error) {
+	var invoiceHistory []InvoiceHistory
+	dbConnection := r.connection()
+	rows, err := dbConnection.Query("SELECT id, invoiceId, action, paymentAmount, expirationTime, eventTime FROM invoiceHistory WHERE invoiceId = ? ORDER BY eventTime ASC", invoiceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry InvoiceHistory
+		rows.Scan(&entry.Id, &entry.InvoiceId, &entry.Action, &entry.PaymentAmount, &entry.ExpirationTime, &entry.EventTime)
+		invoiceHistory = append(invoiceHistory, entry)
+	}
+
+	return invoiceHistory, nil
+}
+
+func (r *sqlRepository) FetchPaymentAmountSumForInvoiceId(invoiceId string) (uint64, error) {
 	var paymentAmountSum uint64
-	dbConnection := GetConnection()
-	if err := dbConnection.QueryRow("SELECT SUM(paymentAmount) FROM walletTransactions WHERE invoiceId = ?", invoiceId).Scan(&paymentAmountSum); err != nil {
+	dbConnection := r.connection()
+	if err := dbConnection.QueryRow("SELECT COALESCE(SUM(paymentAmount), 0) FROM walletTransactions WHERE invoiceId = ?", invoiceId).Scan(&paymentAmountSum); err != nil {
 		return paymentAmountSum, err
 	}
 	return paymentAmountSum, nil
 }
 
-func FetchPendingCallbacks() ([]Callback, error) {
+func (r *sqlRepository) FetchCallbacksByInvoiceId(invoiceId string) ([]Callback, error) {
 	var callbacks []Callback
-	dbConnection := GetConnection()
-	rows, err := dbConnection.Query("SELECT id, invoiceId, requestTime, nextReqTime, reqErrors, status FROM callbacks WHERE status IN (?) AND nextReqTime < NOW()", CallbackStatusCreated)
+	dbConnection := r.connection()
+	rows, err := dbConnection.Query("SELECT id, invoiceId, webhookId, event, sequence, requestTime, nextReqTime, reqErrors, status FROM callbacks WHERE invoiceId = ? ORDER BY sequence ASC", invoiceId)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var callback Callback
-		rows.Scan(&callback.Id, &callback.InvoiceId, &callback.RequestTime, &callback.NextReqTime, &callback.ReqErrors, &callback.Status)
+		rows.Scan(&callback.Id, &callback.InvoiceId, &callback.WebhookId, &callback.Event, &callback.Sequence, &callback.RequestTime, &callback.NextReqTime, &callback.ReqErrors, &callback.Status)
 		callbacks = append(callbacks, callback)
 	}
 
 	return callbacks, nil
 }
+
+func (r *sqlRepository) FetchCallbackById(id string) (Callback, error) {
+	var callback Callback
+	dbConnection := r.connection()
+	if err := dbConnection.QueryRow("SELECT id, invoiceId, webhookId, event, sequence, requestTime, nextReqTime, reqErrors, status FROM callbacks WHERE id = ?", id).Scan(&callback.Id, &callback.InvoiceId, &callback.WebhookId, &callback.Event, &callback.Sequence, &callback.RequestTime, &callback.NextReqTime, &callback.ReqErrors, &callback.Status); err != nil {
+		return callback, err
+	}
+	return callback, nil
+}
+
+func (r *sqlRepository) FetchCallbacksByAccountId(accountId uint32, status CallbackStatus, limit int, offset int) ([]Callback, error) {
+	var callbacks []Callback
+	dbConnection := r.connection()
+
+	// Optionally filter by status
+	query := "SELECT c.id, c.invoiceId, c.webhookId, c.event, c.sequence, c.requestTime, c.nextReqTime, c.reqErrors, c.status FROM callbacks c JOIN invoices i ON i.id = c.invoiceId WHERE i.accountId = ?"
+	args := []interface{}{accountId}
+	if len(status) > 0 {
+		query += " AND c.status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY c.requestTime DESC, c.sequence DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := dbConnection.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var callback Callback
+		rows.Scan(&callback.Id, &callback.InvoiceId, &callback.WebhookId, &callback.Event, &callback.Sequence, &callback.RequestTime, &callback.NextReqTime, &callback.ReqErrors, &callback.Status)
+		callbacks = append(callbacks, callback)
+	}
+
+	return callbacks, nil
+}
+
+func (r *sqlRepository) FetchSettledCallbacksBefore(before time.Time, limit int, offset int) ([]Callback, error) {
+	var callbacks []Callback
+	dbConnection := r.connection()
+
+	// Settled invoices enqueue no further callbacks, so sequence numbers never restart
+	rows, err := dbConnection.Query("SELECT c.id, c.invoiceId, c.webhookId, c.event, c.sequence, c.requestTime, c.nextReqTime, c.reqErrors, c.status FROM callbacks c JOIN invoices i ON i.id = c.invoiceId WHERE c.status IN (?, ?) AND c.requestTime < ? AND i.status IN (?, ?) ORDER BY c.requestTime ASC LIMIT ? OFFSET ?", CallbackStatusDelivered, CallbackStatusFailed, before, InvoiceStatusPaid, InvoiceStatusExpired, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var callback Callback
+		rows.Scan(&callback.Id, &callback.InvoiceId, &callback.WebhookId, &callback.Event, &callback.Sequence, &callback.RequestTime, &callback.NextReqTime, &callback.ReqErrors, &callback.Status)
+		callbacks = append(callbacks, callback)
+	}
+
+	return callbacks, nil
+}
+
+func (r *sqlRepository) FetchAuditEntries(filter AuditFilter, limit int, offset int) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	dbConnection := r.connection()
+
+	// Optionally filter, latest entries first
+	query := "SELECT sequence, eventTime, actor, accountId, action, target, ip, outcome, prevHash, hash FROM auditLog WHERE 1 = 1"
+	var args []interface{}
+	if len(filter.Actor) > 0 {
+		query += " AND actor = ?"
+		args = append(args, filter.Actor)
+	}
+	if filter.AccountId > 0 {
+		query += " AND accountId = ?"
+		args = append(args, filter.AccountId)
+	}
+	if len(filter.Action) > 0 {
+		query += " AND action = ?"
+		args = append(args, filter.Action)
+	}
+	if !filter.Since.IsZero() {
+		query += " AND eventTime >= ?"
+		args = append(args, filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query += " AND eventTime < ?"
+		args = append(args, filter.Until)
+	}
+	query += " ORDER BY sequence DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := dbConnection.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry AuditEntry
+		rows.Scan(&entry.Sequence, &entry.EventTime, &entry.Actor, &entry.AccountId, &entry.Action, &entry.Target, &entry.Ip, &entry.Outcome, &entry.PrevHash, &entry.Hash)
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (r *sqlRepository) FetchAuditEntriesAfter(sequence uint64, limit int) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	dbConnection := r.connection()
+	rows, err := dbConnection.Query("SELECT sequence, eventTime, actor, accountId, action, target, ip, outcome, prevHash, hash FROM auditLog WHERE sequence > ? ORDER BY sequence ASC LIMIT ?", sequence, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry AuditEntry
+		rows.Scan(&entry.Sequence, &entry.EventTime, &entry.Actor, &entry.AccountId, &entry.Action, &entry.Target, &entry.Ip, &entry.Outcome, &entry.PrevHash, &entry.Hash)
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (r *sqlRepository) FetchCallbackAttemptsByCallbackId(callbackId string) ([]CallbackAttempt, error) {
+	var callbackAttempts []CallbackAttempt
+	dbConnection := r.connection()
+	rows, err := dbConnection.Query("SELECT id, callbackId, attemptTime, statusCode, latency, responseBody, error FROM callbackAttempts WHERE callbackId = ? ORDER BY attemptTime ASC", callbackId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var callbackAttempt CallbackAttempt
+		rows.Scan(&callbackAttempt.Id, &callbackAttempt.CallbackId, &callbackAttempt.AttemptTime, &callbackAttempt.StatusCode, &callbackAttempt.Latency, &callbackAttempt.ResponseBody, &callbackAttempt.Error)
+		callbackAttempts = append(callbackAttempts, callbackAttempt)
+	}
+
+	return callbackAttempts, nil
+}
+
+func (r *sqlRepository) ClaimPendingCallbacks(limit int, lease time.Duration) ([]Callback, error) {
+	var callbacks []Callback
+	err := r.transact(func(dbTx executor) error {
+		// Fetch due callbacks not claimed by other instances
+		rows, err := dbTx.Query("SELECT id, invoiceId, webhookId, event, sequence, requestTime, nextReqTime, reqErrors, status FROM callbacks WHERE status IN (?) AND nextReqTime < ? ORDER BY nextReqTime ASC, sequence ASC LIMIT ?"+r.dialect.forUpdateSkipLocked, CallbackStatusCreated, time.Now(), limit)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var callback Callback
+			if err := rows.Scan(&callback.Id, &callback.InvoiceId, &callback.WebhookId, &callback.Event, &callback.Sequence, &callback.RequestTime, &callback.NextReqTime, &callback.ReqErrors, &callback.Status); err != nil {
+				rows.Close()
+				return err
+			}
+			callbacks = append(callbacks, callback)
+		}
+		rows.Close()
+
+		// Lease the callbacks, they become due again should this instance die mid-delivery
+		for _, callback := range callbacks {
+			if _, err := dbTx.Exec("UPDATE callbacks SET nextReqTime = ? WHERE id = ?", time.Now().Add(lease), callback.Id); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return callbacks, nil
+}
+
+func (r *sqlRepository) ReleaseCallbackClaim(id string) error {
+	dbConnection := r.connection()
+
+	// Make the callback due again
+	if _, err := dbConnection.Exec("UPDATE callbacks SET nextReqTime = ? WHERE id = ? AND status = ?", time.Now(), id, CallbackStatusCreated); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,257 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	KeyPrefixLength    = 8
+	EnvelopeKeyLength  = 32
+	sealedValuePrefix  = "v1:"
+	sealedValuePattern = sealedValuePrefix + "%"
+)
+
+var (
+	ErrEnvelopeKeyMissing = errors.New("envelope key missing")
+	ErrEnvelopeKeyInvalid = errors.New("envelope key must be 32 bytes encoded as base64")
+	ErrValueNotSealed     = errors.New("value is not sealed with the envelope key")
+	ErrKeysUnprotected    = errors.New("database holds plaintext keys or secrets")
+)
+
+// KeyPrefix returns the part of a key stored in plaintext to look it up by
+func KeyPrefix(key string) string {
+	if len(key) < KeyPrefixLength {
+		return key
+	}
+	return key[:KeyPrefixLength]
+}
+
+// HashKey returns the digest a key is stored as, keys are random and need no
+// slow hash
+func HashKey(key string) string {
+	digest := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(digest[:])
+}
+
+func keyMatches(key string, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashKey(key)), []byte(hash)) == 1
+}
+
+// NewAccountKeys generates the key material of an account, revealed to
+// the merchant once
+func NewAccountKeys(account *Account) {
+	account.ApiKey = uuid.New().String()
+	account.ViewKey = uuid.New().String()
+	account.SecretKey = uuid.New().String()
+}
+
+// SaveAccountKeys stores the account's API key with all scopes and its view
+// key with invoices:view, only their hashes are kept
+func SaveAccountKeys(repositories Repositories, account Account) error {
+	keys := []ApiKey{
+		{Label: "apiKey", Key: account.ApiKey, Scopes: joinScopes(ApiKeyScopes())},
+		{Label: "viewKey", Key: account.ViewKey, Scopes: joinScopes([]ApiKeyScope{ApiKeyScopeInvoicesView})},
+	}
+	for j := range keys {
+		keys[j].Id = uuid.New().String()
+		keys[j].AccountId = account.Id
+		keys[j].CreationTime = time.Now()
+		if err := repositories.SaveApiKey(&keys[j]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func joinScopes(scopes []ApiKeyScope) string {
+	var joined []string
+	for _, scope := range scopes {
+		joined = append(joined, string(scope))
+	}
+	return strings.Join(joined, ",")
+}
+
+// envelope seals secrets which have to be read back, like the HMAC secrets,
+// with AES-256-GCM under a key kept outside the database
+type envelope struct {
+	aead cipher.AEAD
+}
+
+// LoadEnvelopeKey reads the base64 encoded envelope key, from the file if
+// one is given
+func LoadEnvelopeKey(encodedKey string, keyFile string) ([]byte, error) {
+	if len(encodedKey) == 0 && len(keyFile) == 0 {
+		return nil, ErrEnvelopeKeyMissing
+	}
+	if len(keyFile) > 0 {
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		encodedKey = string(content)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKey))
+	if err != nil || len(key) != EnvelopeKeyLength {
+		return nil, ErrEnvelopeKeyInvalid
+	}
+	return key, nil
+}
+
+func newEnvelope(key []byte) (*envelope, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &envelope{aead: aead}, nil
+}
+
+func (e *envelope) seal(value string) (string, error) {
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := e.aead.Seal(nonce, nonce, []byte(value), nil)
+	return sealedValuePrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (e *envelope) open(value string) (string, error) {
+	if !strings.HasPrefix(value, sealedValuePrefix) {
+		return "", ErrValueNotSealed
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, sealedValuePrefix))
+	if err != nil || len(sealed) < e.aead.NonceSize() {
+		return "", ErrValueNotSealed
+	}
+	opened, err := e.aead.Open(nil, sealed[:e.aead.NonceSize()], sealed[e.aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("opening sealed value failed: %w", err)
+	}
+	return string(opened), nil
+}
+
+// protectKeys moves plaintext API and view keys into the hashed apiKeys and
+// seals plaintext secrets, for databases predating both or accounts inserted
+// by hand
+func (s *sqlStore) protectKeys(apply bool) error {
+	return s.transact(func(dbTx executor) error {
+		type plaintextAccount struct {
+			id        uint32
+			apiKey    string
+			viewKey   string
+			secretKey string
+		}
+		type plaintextSecret struct {
+			table  string
+			id     string
+			secret string
+		}
+
+		// Collect first, MySQL connections can't update while rows are open
+		var accounts []plaintextAccount
+		rows, err := dbTx.Query("SELECT id, apiKey, viewKey, secretKey FROM accounts WHERE apiKey IS NOT NULL OR viewKey IS NOT NULL OR secretKey NOT LIKE ?", sealedValuePattern)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var account plaintextAccount
+			var apiKey, viewKey *string
+			if err := rows.Scan(&account.id, &apiKey, &viewKey, &account.secretKey); err != nil {
+				rows.Close()
+				return err
+			}
+			if apiKey != nil {
+				account.apiKey = *apiKey
+			}
+			if viewKey != nil {
+				account.viewKey = *viewKey
+			}
+			accounts = append(accounts, account)
+		}
+		rows.Close()
+
+		var secrets []plaintextSecret
+		for _, table := range []string{"callbackSecrets", "webhookEndpoints"} {
+			rows, err := dbTx.Query("SELECT id, secret FROM "+table+" WHERE secret NOT LIKE ?", sealedValuePattern)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				secret := plaintextSecret{table: table}
+				if err := rows.Scan(&secret.id, &secret.secret); err != nil {
+					rows.Close()
+					return err
+				}
+				secrets = append(secrets, secret)
+			}
+			rows.Close()
+		}
+
+		if len(accounts) == 0 && len(secrets) == 0 {
+			return nil
+		}
+		if !apply {
+			return fmt.Errorf("%w: %d accounts, %d secrets", ErrKeysUnprotected, len(accounts), len(secrets))
+		}
+		log.Info().Int("accounts", len(accounts)).Int("secrets", len(secrets)).Msg("Protecting plaintext keys and secrets")
+
+		for _, account := range accounts {
+			secretKey := account.secretKey
+			if !strings.HasPrefix(secretKey, sealedValuePrefix) {
+				if secretKey, err = s.envelope.seal(secretKey); err != nil {
+					return err
+				}
+			}
+			// The account's keys become keys of their own, the API key with all scopes
+			keys := []struct {
+				key    string
+				label  string
+				scopes []ApiKeyScope
+			}{
+				{key: account.apiKey, label: "apiKey", scopes: ApiKeyScopes()},
+				{key: account.viewKey, label: "viewKey", scopes: []ApiKeyScope{ApiKeyScopeInvoicesView}},
+			}
+			for _, key := range keys {
+				if len(key.key) == 0 {
+					continue
+				}
+				if _, err := dbTx.Exec("INSERT INTO apiKeys (id, accountId, label, prefix, hash, scopes, creationTime) VALUES (?, ?, ?, ?, ?, ?, ?)", uuid.New().String(), account.id, key.label, KeyPrefix(key.key), HashKey(key.key), joinScopes(key.scopes), time.Now()); err != nil {
+					return err
+				}
+			}
+			if _, err := dbTx.Exec("UPDATE accounts SET apiKey = NULL, viewKey = NULL, secretKey = ? WHERE id = ?", secretKey, account.id); err != nil {
+				return err
+			}
+		}
+
+		for _, secret := range secrets {
+			sealed, err := s.envelope.seal(secret.secret)
+			if err != nil {
+				return err
+			}
+			if _, err := dbTx.Exec("UPDATE "+secret.table+" SET secret = ? WHERE id = ?", sealed, secret.id); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
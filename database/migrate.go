@@ -0,0 +1,234 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+var (
+	ErrSchemaAhead   = errors.New("database schema is ahead of this binary")
+	ErrSchemaBehind  = errors.New("database schema has pending migrations")
+	ErrSchemaChanged = errors.New("applied migration differs from this binary")
+	ErrSchemaUnknown = errors.New("database schema predates migrations but differs from the initial one")
+)
+
+type Migration struct {
+	Version  int
+	Name     string
+	Checksum string
+	Sql      string
+}
+
+// Migrations lists the embedded migrations of a backend in order of version,
+// named migrations/<backend>/<version>_<name>.sql
+func Migrations(backend string) ([]Migration, error) {
+	directory := path.Join("migrations", backend)
+	entries, err := migrationFiles.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		version, name, found := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		if !found {
+			return nil, fmt.Errorf("migration %s: name must be <version>_<name>.sql", entry.Name())
+		}
+		var migration Migration
+		if migration.Version, err = strconv.Atoi(version); err != nil {
+			return nil, fmt.Errorf("migration %s: %w", entry.Name(), err)
+		}
+		content, err := migrationFiles.ReadFile(path.Join(directory, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		checksum := sha256.Sum256(content)
+		migration.Name = name
+		migration.Checksum = hex.EncodeToString(checksum[:])
+		migration.Sql = string(content)
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Statements splits the migration at semicolons ending a line
+func (m Migration) Statements() []string {
+	var statements []string
+	for _, statement := range strings.Split(m.Sql, ";\n") {
+		statement = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(statement), ";"))
+		if len(statement) > 0 {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+// migrate compares the applied migrations with the embedded ones and applies
+// the pending ones if asked to, or fails if there are any
+func migrate(db *sql.DB, dialect *dialect, apply bool) error {
+	migrations, err := Migrations(dialect.name)
+	if err != nil {
+		return err
+	}
+
+	// Serialize instances starting at the same time on a single connection
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if len(dialect.migrationsLock) > 0 {
+		var locked sql.NullInt64
+		if err := conn.QueryRowContext(ctx, dialect.migrationsLock).Scan(&locked); err != nil {
+			return err
+		}
+		if locked.Int64 != 1 {
+			return errors.New("acquiring migrations lock timed out")
+		}
+		defer conn.ExecContext(ctx, dialect.migrationsUnlock)
+	}
+
+	// Track applied versions
+	if _, err := conn.ExecContext(ctx, dialect.migrationsTable); err != nil {
+		return err
+	}
+	applied, err := fetchAppliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	// Databases restored from the scheme formerly in the README count as the
+	// initial migration. Ones already extended by hand can't be told apart
+	// from partially migrated ones and have to be recorded by hand as well.
+	if len(applied) == 0 {
+		var tables int
+		query, args := dialect.bind(dialect.tableExists, []any{"accounts"})
+		if err := conn.QueryRowContext(ctx, query, args...).Scan(&tables); err != nil {
+			return err
+		}
+		if tables > 0 {
+			var columns int
+			query, args := dialect.bind(dialect.columnExists, []any{"accounts", "uniqueClientId"})
+			if err := conn.QueryRowContext(ctx, query, args...).Scan(&columns); err != nil {
+				return err
+			}
+			if columns > 0 {
+				return ErrSchemaUnknown
+			}
+			log.Warn().Int("version", migrations[0].Version).Msg("Recording existing database scheme as initial migration")
+			if err := recordMigration(ctx, conn, dialect, migrations[0]); err != nil {
+				return err
+			}
+			applied[migrations[0].Version] = migrations[0].Checksum
+		}
+	}
+
+	// Refuse databases migrated by newer or different binaries
+	known := make(map[int]string)
+	for _, migration := range migrations {
+		known[migration.Version] = migration.Checksum
+	}
+	for version, checksum := range applied {
+		knownChecksum, ok := known[version]
+		if !ok {
+			return fmt.Errorf("%w: version %d unknown", ErrSchemaAhead, version)
+		}
+		if knownChecksum != checksum {
+			return fmt.Errorf("%w: version %d", ErrSchemaChanged, version)
+		}
+	}
+
+	// Apply pending migrations in order
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		if !apply {
+			return fmt.Errorf("%w: version %d", ErrSchemaBehind, migration.Version)
+		}
+		log.Info().Int("version", migration.Version).Str("name", migration.Name).Msg("Applying database migration")
+		if err := applyMigration(ctx, conn, dialect, migration); err != nil {
+			return fmt.Errorf("migration %d: %w", migration.Version, err)
+		}
+	}
+
+	return nil
+}
+
+// migrationExecutor is satisfied by both *sql.Conn and *sql.Tx
+type migrationExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// applyMigration runs the statements of a migration and records it, all or
+// nothing where the backend rolls back schema changes. MySQL commits each of
+// them implicitly, a migration failing partway has to be repaired by hand.
+func applyMigration(ctx context.Context, conn *sql.Conn, dialect *dialect, migration Migration) error {
+	if !dialect.transactionalDdl {
+		return runMigration(ctx, conn, dialect, migration)
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := runMigration(ctx, tx, dialect, migration); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func runMigration(ctx context.Context, executor migrationExecutor, dialect *dialect, migration Migration) error {
+	for _, statement := range migration.Statements() {
+		if _, err := executor.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return recordMigration(ctx, executor, dialect, migration)
+}
+
+func fetchAppliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]string, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, checksum FROM schemaMigrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var checksum string
+		if err := rows.Scan(&version, &checksum); err != nil {
+			return nil, err
+		}
+		applied[version] = checksum
+	}
+
+	return applied, rows.Err()
+}
+
+func recordMigration(ctx context.Context, executor migrationExecutor, dialect *dialect, migration Migration) error {
+	query, args := dialect.bind("INSERT INTO schemaMigrations (version, name, checksum) VALUES (?, ?, ?)", []any{migration.Version, migration.Name, migration.Checksum})
+	_, err := executor.ExecContext(ctx, query, args...)
+	return err
+}
@@ -0,0 +1,50 @@
+package database
+
+import (
+	"context"
+	"testing"
+)
+
+func TestApplyMigrationRollsBack(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	conn, err := store.db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The second statement fails, the first one must not stay behind
+	migration := Migration{
+		Version:  999,
+		Name:     "broken",
+		Checksum: "checksum",
+		Sql:      "CREATE TABLE `brokenMigration` (`id` INTEGER NOT NULL);\nCREATE TABLE `brokenMigration` (`id` INTEGER NOT NULL);\n",
+	}
+	if err := applyMigration(ctx, conn, &sqliteDialect, migration); err == nil {
+		t.Fatal("applying a failing migration succeeded")
+	}
+
+	var tables, versions int
+	if err := conn.QueryRowContext(ctx, sqliteDialect.tableExists, "brokenMigration").Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM schemaMigrations WHERE version = ?", migration.Version).Scan(&versions); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 || versions != 0 {
+		t.Fatalf("failed migration left %d tables and %d versions behind", tables, versions)
+	}
+
+	// Applying it once fixed records it
+	migration.Sql = "CREATE TABLE `brokenMigration` (`id` INTEGER NOT NULL);\n"
+	if err := applyMigration(ctx, conn, &sqliteDialect, migration); err != nil {
+		t.Fatalf("applying fixed migration: %v", err)
+	}
+	if err := conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM schemaMigrations WHERE version = ?", migration.Version).Scan(&versions); err != nil {
+		t.Fatal(err)
+	}
+	if versions != 1 {
+		t.Fatalf("fixed migration recorded %d times", versions)
+	}
+}
@@ -0,0 +1,70 @@
+CREATE TABLE `accounts` (
+  `id` int(10) UNSIGNED NOT NULL,
+  `merchant` varchar(32) NOT NULL,
+  `apiKey` varchar(36) NOT NULL,
+  `viewKey` varchar(36) NOT NULL,
+  `secretKey` varchar(36) NOT NULL,
+  `coldWallet` varchar(43) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+CREATE TABLE `callbacks` (
+  `id` varchar(36) NOT NULL,
+  `invoiceId` varchar(36) NOT NULL,
+  `requestTime` timestamp NOT NULL DEFAULT '0000-00-00 00:00:00',
+  `nextReqTime` timestamp NOT NULL DEFAULT '0000-00-00 00:00:00',
+  `reqErrors` int(11) NOT NULL,
+  `status` varchar(16) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+CREATE TABLE `invoices` (
+  `id` varchar(36) NOT NULL,
+  `clientId` varchar(36) NOT NULL,
+  `accountId` int(11) NOT NULL,
+  `paymentAmount` double NOT NULL,
+  `paymentAddress` varchar(43) NOT NULL,
+  `paymentDescription` varchar(64) NOT NULL,
+  `callbackUrl` varchar(64) DEFAULT NULL,
+  `creationTime` timestamp NOT NULL DEFAULT '0000-00-00 00:00:00',
+  `expirationTime` timestamp NOT NULL DEFAULT '0000-00-00 00:00:00',
+  `status` varchar(16) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+CREATE TABLE `walletAddresses` (
+  `address` varchar(43) NOT NULL,
+  `lastUsed` timestamp NOT NULL DEFAULT '0000-00-00 00:00:00',
+  `inUse` tinyint(1) NOT NULL DEFAULT 0
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+CREATE TABLE `walletTransactions` (
+  `id` varchar(64) NOT NULL,
+  `invoiceId` varchar(36) NOT NULL,
+  `walletAddress` varchar(43) NOT NULL,
+  `paymentAmount` double UNSIGNED NOT NULL,
+  `confirmationTime` timestamp NOT NULL DEFAULT '0000-00-00 00:00:00',
+  `discoveryTime` timestamp NOT NULL DEFAULT '0000-00-00 00:00:00'
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+ALTER TABLE `accounts`
+  ADD PRIMARY KEY (`id`),
+  ADD UNIQUE KEY `apiKey` (`apiKey`),
+  ADD UNIQUE KEY `viewKey` (`viewKey`),
+  ADD UNIQUE KEY `secretKey` (`secretKey`),
+  ADD UNIQUE KEY `coldWallet` (`coldWallet`);
+
+ALTER TABLE `callbacks`
+  ADD PRIMARY KEY (`id`),
+  ADD UNIQUE KEY `invoiceId` (`invoiceId`);
+
+ALTER TABLE `invoices`
+  ADD PRIMARY KEY (`id`),
+  ADD KEY `id` (`id`,`paymentAddress`);
+
+ALTER TABLE `walletAddresses`
+  ADD PRIMARY KEY (`address`);
+
+ALTER TABLE `walletTransactions`
+  ADD PRIMARY KEY (`id`),
+  ADD KEY `id` (`id`,`invoiceId`);
+
+ALTER TABLE `accounts`
+  MODIFY `id` int(10) UNSIGNED NOT NULL AUTO_INCREMENT;
@@ -0,0 +1,81 @@
+ALTER TABLE `accounts`
+  ADD `uniqueClientId` tinyint(1) NOT NULL DEFAULT 0,
+  ADD `invoiceExtensions` int(11) NOT NULL DEFAULT 3,
+  ADD `invoiceMaxLifetime` int(11) NOT NULL DEFAULT 1440,
+  ADD `callbackEvents` varchar(255) NOT NULL DEFAULT 'invoice.paid,invoice.expired',
+  ADD `callbackRetryPolicy` varchar(512) NOT NULL DEFAULT '',
+  ADD `callbackAcknowledgement` varchar(8) NOT NULL DEFAULT '';
+
+ALTER TABLE `callbacks`
+  ADD `webhookId` varchar(36) NOT NULL DEFAULT '' AFTER `invoiceId`,
+  ADD `event` varchar(32) NOT NULL DEFAULT '' AFTER `webhookId`,
+  ADD `sequence` int(11) NOT NULL DEFAULT 0 AFTER `event`,
+  DROP KEY `invoiceId`,
+  ADD KEY `invoiceId` (`invoiceId`),
+  ADD KEY `status` (`status`,`nextReqTime`);
+
+UPDATE `callbacks` INNER JOIN `invoices` ON `invoices`.`id` = `callbacks`.`invoiceId`
+  SET `callbacks`.`event` = CONCAT('invoice.', `invoices`.`status`), `callbacks`.`sequence` = 1;
+
+ALTER TABLE `callbacks`
+  ALTER `event` DROP DEFAULT,
+  ALTER `sequence` DROP DEFAULT;
+
+CREATE TABLE `callbackAttempts` (
+  `id` varchar(36) NOT NULL,
+  `callbackId` varchar(36) NOT NULL,
+  `attemptTime` timestamp NOT NULL DEFAULT '0000-00-00 00:00:00',
+  `statusCode` int(11) NOT NULL,
+  `latency` int(11) NOT NULL,
+  `responseBody` varchar(1024) NOT NULL,
+  `error` varchar(255) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+CREATE TABLE `callbackSecrets` (
+  `id` varchar(36) NOT NULL,
+  `accountId` int(11) NOT NULL,
+  `webhookId` varchar(36) NOT NULL DEFAULT '',
+  `secret` varchar(36) NOT NULL,
+  `creationTime` timestamp NOT NULL DEFAULT '0000-00-00 00:00:00',
+  `expirationTime` timestamp NULL DEFAULT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+CREATE TABLE `invoiceHistory` (
+  `id` varchar(36) NOT NULL,
+  `invoiceId` varchar(36) NOT NULL,
+  `action` varchar(16) NOT NULL,
+  `paymentAmount` double UNSIGNED NOT NULL,
+  `expirationTime` timestamp NOT NULL DEFAULT '0000-00-00 00:00:00',
+  `eventTime` timestamp NOT NULL DEFAULT '0000-00-00 00:00:00'
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+CREATE TABLE `webhookEndpoints` (
+  `id` varchar(36) NOT NULL,
+  `accountId` int(11) NOT NULL,
+  `url` varchar(255) NOT NULL,
+  `events` varchar(255) NOT NULL DEFAULT '',
+  `secret` varchar(36) NOT NULL,
+  `enabled` tinyint(1) NOT NULL DEFAULT 1,
+  `creationTime` timestamp NOT NULL DEFAULT '0000-00-00 00:00:00'
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+ALTER TABLE `callbackAttempts`
+  ADD PRIMARY KEY (`id`),
+  ADD KEY `callbackId` (`callbackId`);
+
+ALTER TABLE `callbackSecrets`
+  ADD PRIMARY KEY (`id`),
+  ADD KEY `accountId` (`accountId`),
+  ADD KEY `webhookId` (`webhookId`);
+
+ALTER TABLE `invoices`
+  MODIFY `callbackUrl` varchar(255) DEFAULT NULL,
+  ADD KEY `clientId` (`accountId`,`clientId`);
+
+ALTER TABLE `invoiceHistory`
+  ADD PRIMARY KEY (`id`),
+  ADD KEY `invoiceId` (`invoiceId`);
+
+ALTER TABLE `webhookEndpoints`
+  ADD PRIMARY KEY (`id`),
+  ADD KEY `accountId` (`accountId`);
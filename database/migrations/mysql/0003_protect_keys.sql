@@ -0,0 +1,10 @@
+ALTER TABLE `accounts`
+  MODIFY `apiKey` varchar(36) DEFAULT NULL,
+  MODIFY `viewKey` varchar(36) DEFAULT NULL,
+  MODIFY `secretKey` varchar(128) NOT NULL;
+
+ALTER TABLE `callbackSecrets`
+  MODIFY `secret` varchar(128) NOT NULL;
+
+ALTER TABLE `webhookEndpoints`
+  MODIFY `secret` varchar(128) NOT NULL;
@@ -0,0 +1,19 @@
+CREATE TABLE `apiKeys` (
+  `id` varchar(36) NOT NULL,
+  `accountId` int(10) UNSIGNED NOT NULL,
+  `label` varchar(64) NOT NULL DEFAULT '',
+  `prefix` varchar(8) NOT NULL,
+  `hash` varchar(64) NOT NULL,
+  `scopes` varchar(255) NOT NULL,
+  `secretKey` varchar(128) NOT NULL DEFAULT '',
+  `creationTime` timestamp NOT NULL DEFAULT '0000-00-00 00:00:00',
+  `expirationTime` timestamp NULL DEFAULT NULL,
+  `lastUsedTime` timestamp NULL DEFAULT NULL,
+  `revocationTime` timestamp NULL DEFAULT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+ALTER TABLE `apiKeys`
+  ADD PRIMARY KEY (`id`),
+  ADD UNIQUE KEY `hash` (`hash`),
+  ADD KEY `prefix` (`prefix`),
+  ADD KEY `accountId` (`accountId`);
@@ -0,0 +1,2 @@
+ALTER TABLE `accounts`
+  ADD `suspended` tinyint(1) NOT NULL DEFAULT 0 AFTER `coldWallet`;
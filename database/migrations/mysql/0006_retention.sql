@@ -0,0 +1,8 @@
+ALTER TABLE `invoices`
+  ADD KEY `status` (`status`,`expirationTime`);
+
+ALTER TABLE `callbacks`
+  ADD KEY `requestTime` (`status`,`requestTime`);
+
+ALTER TABLE `walletTransactions`
+  ADD KEY `invoiceId` (`invoiceId`);
@@ -0,0 +1,17 @@
+CREATE TABLE `auditLog` (
+  `sequence` bigint(20) UNSIGNED NOT NULL,
+  `eventTime` timestamp NOT NULL DEFAULT '0000-00-00 00:00:00',
+  `actor` varchar(64) NOT NULL,
+  `accountId` int(10) UNSIGNED NOT NULL DEFAULT 0,
+  `action` varchar(64) NOT NULL,
+  `target` varchar(255) NOT NULL,
+  `ip` varchar(45) NOT NULL,
+  `outcome` int(11) NOT NULL,
+  `prevHash` varchar(64) NOT NULL,
+  `hash` varchar(64) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+ALTER TABLE `auditLog`
+  ADD PRIMARY KEY (`sequence`),
+  ADD KEY `accountId` (`accountId`,`sequence`),
+  ADD KEY `eventTime` (`eventTime`);
@@ -0,0 +1,70 @@
+ALTER TABLE accounts
+  ADD COLUMN uniqueClientId boolean NOT NULL DEFAULT false,
+  ADD COLUMN invoiceExtensions integer NOT NULL DEFAULT 3,
+  ADD COLUMN invoiceMaxLifetime integer NOT NULL DEFAULT 1440,
+  ADD COLUMN callbackEvents varchar(255) NOT NULL DEFAULT 'invoice.paid,invoice.expired',
+  ADD COLUMN callbackRetryPolicy varchar(512) NOT NULL DEFAULT '',
+  ADD COLUMN callbackAcknowledgement varchar(8) NOT NULL DEFAULT '';
+
+ALTER TABLE callbacks
+  ADD COLUMN webhookId varchar(36) NOT NULL DEFAULT '',
+  ADD COLUMN event varchar(32) NOT NULL DEFAULT '',
+  ADD COLUMN sequence integer NOT NULL DEFAULT 0;
+
+UPDATE callbacks SET event = 'invoice.' || invoices.status, sequence = 1
+  FROM invoices WHERE invoices.id = callbacks.invoiceId;
+
+ALTER TABLE callbacks
+  ALTER COLUMN event DROP DEFAULT,
+  ALTER COLUMN sequence DROP DEFAULT;
+
+ALTER TABLE invoices
+  ALTER COLUMN callbackUrl TYPE varchar(255);
+
+CREATE TABLE callbackAttempts (
+  id varchar(36) NOT NULL PRIMARY KEY,
+  callbackId varchar(36) NOT NULL,
+  attemptTime timestamptz NOT NULL,
+  statusCode integer NOT NULL,
+  latency bigint NOT NULL,
+  responseBody varchar(1024) NOT NULL,
+  error varchar(255) NOT NULL
+);
+
+CREATE TABLE callbackSecrets (
+  id varchar(36) NOT NULL PRIMARY KEY,
+  accountId integer NOT NULL,
+  webhookId varchar(36) NOT NULL DEFAULT '',
+  secret varchar(36) NOT NULL,
+  creationTime timestamptz NOT NULL,
+  expirationTime timestamptz NULL DEFAULT NULL
+);
+
+CREATE TABLE invoiceHistory (
+  id varchar(36) NOT NULL PRIMARY KEY,
+  invoiceId varchar(36) NOT NULL,
+  action varchar(16) NOT NULL,
+  paymentAmount bigint NOT NULL,
+  expirationTime timestamptz NOT NULL,
+  eventTime timestamptz NOT NULL
+);
+
+CREATE TABLE webhookEndpoints (
+  id varchar(36) NOT NULL PRIMARY KEY,
+  accountId integer NOT NULL,
+  url varchar(255) NOT NULL,
+  events varchar(255) NOT NULL DEFAULT '',
+  secret varchar(36) NOT NULL,
+  enabled boolean NOT NULL DEFAULT true,
+  creationTime timestamptz NOT NULL
+);
+
+DROP INDEX callbacks_invoiceId;
+CREATE INDEX callbacks_invoiceId ON callbacks (invoiceId);
+CREATE INDEX callbacks_status ON callbacks (status, nextReqTime);
+CREATE INDEX callbackAttempts_callbackId ON callbackAttempts (callbackId);
+CREATE INDEX callbackSecrets_accountId ON callbackSecrets (accountId);
+CREATE INDEX callbackSecrets_webhookId ON callbackSecrets (webhookId);
+CREATE INDEX invoices_clientId ON invoices (accountId, clientId);
+CREATE INDEX invoiceHistory_invoiceId ON invoiceHistory (invoiceId);
+CREATE INDEX webhookEndpoints_accountId ON webhookEndpoints (accountId);
@@ -0,0 +1,10 @@
+ALTER TABLE accounts
+  ALTER COLUMN apiKey DROP NOT NULL,
+  ALTER COLUMN viewKey DROP NOT NULL,
+  ALTER COLUMN secretKey TYPE varchar(128);
+
+ALTER TABLE callbackSecrets
+  ALTER COLUMN secret TYPE varchar(128);
+
+ALTER TABLE webhookEndpoints
+  ALTER COLUMN secret TYPE varchar(128);
@@ -0,0 +1,16 @@
+CREATE TABLE apiKeys (
+  id varchar(36) NOT NULL PRIMARY KEY,
+  accountId integer NOT NULL,
+  label varchar(64) NOT NULL DEFAULT '',
+  prefix varchar(8) NOT NULL,
+  hash varchar(64) NOT NULL UNIQUE,
+  scopes varchar(255) NOT NULL,
+  secretKey varchar(128) NOT NULL DEFAULT '',
+  creationTime timestamptz NOT NULL,
+  expirationTime timestamptz NULL DEFAULT NULL,
+  lastUsedTime timestamptz NULL DEFAULT NULL,
+  revocationTime timestamptz NULL DEFAULT NULL
+);
+
+CREATE INDEX apiKeys_prefix ON apiKeys (prefix);
+CREATE INDEX apiKeys_accountId ON apiKeys (accountId);
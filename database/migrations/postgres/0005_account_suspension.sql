@@ -0,0 +1,2 @@
+ALTER TABLE accounts
+  ADD COLUMN suspended boolean NOT NULL DEFAULT false;
@@ -0,0 +1,2 @@
+CREATE INDEX invoices_status ON invoices (status, expirationTime);
+CREATE INDEX callbacks_requestTime ON callbacks (status, requestTime);
@@ -0,0 +1,49 @@
+CREATE TABLE `accounts` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `merchant` varchar(32) NOT NULL,
+  `apiKey` varchar(36) NOT NULL UNIQUE,
+  `viewKey` varchar(36) NOT NULL UNIQUE,
+  `secretKey` varchar(36) NOT NULL UNIQUE,
+  `coldWallet` varchar(43) NOT NULL UNIQUE
+);
+
+CREATE TABLE `callbacks` (
+  `id` varchar(36) NOT NULL PRIMARY KEY,
+  `invoiceId` varchar(36) NOT NULL,
+  `requestTime` timestamp NOT NULL,
+  `nextReqTime` timestamp NOT NULL,
+  `reqErrors` INTEGER NOT NULL,
+  `status` varchar(16) NOT NULL
+);
+
+CREATE TABLE `invoices` (
+  `id` varchar(36) NOT NULL PRIMARY KEY,
+  `clientId` varchar(36) NOT NULL,
+  `accountId` INTEGER NOT NULL,
+  `paymentAmount` INTEGER NOT NULL,
+  `paymentAddress` varchar(43) NOT NULL,
+  `paymentDescription` varchar(64) NOT NULL,
+  `callbackUrl` varchar(64) DEFAULT NULL,
+  `creationTime` timestamp NOT NULL,
+  `expirationTime` timestamp NOT NULL,
+  `status` varchar(16) NOT NULL
+);
+
+CREATE TABLE `walletAddresses` (
+  `address` varchar(43) NOT NULL PRIMARY KEY,
+  `lastUsed` timestamp NOT NULL DEFAULT '1970-01-01 00:00:00',
+  `inUse` tinyint(1) NOT NULL DEFAULT 0
+);
+
+CREATE TABLE `walletTransactions` (
+  `id` varchar(64) NOT NULL PRIMARY KEY,
+  `invoiceId` varchar(36) NOT NULL,
+  `walletAddress` varchar(43) NOT NULL,
+  `paymentAmount` INTEGER NOT NULL,
+  `confirmationTime` timestamp NOT NULL,
+  `discoveryTime` timestamp NOT NULL
+);
+
+CREATE UNIQUE INDEX `callbacks_invoiceId` ON `callbacks` (`invoiceId`);
+CREATE INDEX `invoices_paymentAddress` ON `invoices` (`paymentAddress`, `status`);
+CREATE INDEX `walletTransactions_invoiceId` ON `walletTransactions` (`invoiceId`);
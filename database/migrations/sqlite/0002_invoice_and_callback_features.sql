@@ -0,0 +1,63 @@
+ALTER TABLE `accounts` ADD COLUMN `uniqueClientId` tinyint(1) NOT NULL DEFAULT 0;
+ALTER TABLE `accounts` ADD COLUMN `invoiceExtensions` INTEGER NOT NULL DEFAULT 3;
+ALTER TABLE `accounts` ADD COLUMN `invoiceMaxLifetime` INTEGER NOT NULL DEFAULT 1440;
+ALTER TABLE `accounts` ADD COLUMN `callbackEvents` varchar(255) NOT NULL DEFAULT 'invoice.paid,invoice.expired';
+ALTER TABLE `accounts` ADD COLUMN `callbackRetryPolicy` varchar(512) NOT NULL DEFAULT '';
+ALTER TABLE `accounts` ADD COLUMN `callbackAcknowledgement` varchar(8) NOT NULL DEFAULT '';
+
+ALTER TABLE `callbacks` ADD COLUMN `webhookId` varchar(36) NOT NULL DEFAULT '';
+ALTER TABLE `callbacks` ADD COLUMN `event` varchar(32) NOT NULL DEFAULT '';
+ALTER TABLE `callbacks` ADD COLUMN `sequence` INTEGER NOT NULL DEFAULT 0;
+
+UPDATE `callbacks` SET
+  `event` = 'invoice.' || (SELECT `status` FROM `invoices` WHERE `invoices`.`id` = `callbacks`.`invoiceId`),
+  `sequence` = 1
+  WHERE `invoiceId` IN (SELECT `id` FROM `invoices`);
+
+CREATE TABLE `callbackAttempts` (
+  `id` varchar(36) NOT NULL PRIMARY KEY,
+  `callbackId` varchar(36) NOT NULL,
+  `attemptTime` timestamp NOT NULL,
+  `statusCode` INTEGER NOT NULL,
+  `latency` INTEGER NOT NULL,
+  `responseBody` varchar(1024) NOT NULL,
+  `error` varchar(255) NOT NULL
+);
+
+CREATE TABLE `callbackSecrets` (
+  `id` varchar(36) NOT NULL PRIMARY KEY,
+  `accountId` INTEGER NOT NULL,
+  `webhookId` varchar(36) NOT NULL DEFAULT '',
+  `secret` varchar(36) NOT NULL,
+  `creationTime` timestamp NOT NULL,
+  `expirationTime` timestamp NULL DEFAULT NULL
+);
+
+CREATE TABLE `invoiceHistory` (
+  `id` varchar(36) NOT NULL PRIMARY KEY,
+  `invoiceId` varchar(36) NOT NULL,
+  `action` varchar(16) NOT NULL,
+  `paymentAmount` INTEGER NOT NULL,
+  `expirationTime` timestamp NOT NULL,
+  `eventTime` timestamp NOT NULL
+);
+
+CREATE TABLE `webhookEndpoints` (
+  `id` varchar(36) NOT NULL PRIMARY KEY,
+  `accountId` INTEGER NOT NULL,
+  `url` varchar(255) NOT NULL,
+  `events` varchar(255) NOT NULL DEFAULT '',
+  `secret` varchar(36) NOT NULL,
+  `enabled` tinyint(1) NOT NULL DEFAULT 1,
+  `creationTime` timestamp NOT NULL
+);
+
+DROP INDEX `callbacks_invoiceId`;
+CREATE INDEX `callbacks_invoiceId` ON `callbacks` (`invoiceId`);
+CREATE INDEX `callbacks_status` ON `callbacks` (`status`, `nextReqTime`);
+CREATE INDEX `callbackAttempts_callbackId` ON `callbackAttempts` (`callbackId`);
+CREATE INDEX `callbackSecrets_accountId` ON `callbackSecrets` (`accountId`);
+CREATE INDEX `callbackSecrets_webhookId` ON `callbackSecrets` (`webhookId`);
+CREATE INDEX `invoices_clientId` ON `invoices` (`accountId`, `clientId`);
+CREATE INDEX `invoiceHistory_invoiceId` ON `invoiceHistory` (`invoiceId`);
+CREATE INDEX `webhookEndpoints_accountId` ON `webhookEndpoints` (`accountId`);
@@ -0,0 +1,21 @@
+CREATE TABLE `accountsProtected` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `merchant` varchar(32) NOT NULL,
+  `apiKey` varchar(36) DEFAULT NULL UNIQUE,
+  `viewKey` varchar(36) DEFAULT NULL UNIQUE,
+  `secretKey` varchar(128) NOT NULL UNIQUE,
+  `coldWallet` varchar(43) NOT NULL UNIQUE,
+  `uniqueClientId` tinyint(1) NOT NULL DEFAULT 0,
+  `invoiceExtensions` INTEGER NOT NULL DEFAULT 3,
+  `invoiceMaxLifetime` INTEGER NOT NULL DEFAULT 1440,
+  `callbackEvents` varchar(255) NOT NULL DEFAULT 'invoice.paid,invoice.expired',
+  `callbackRetryPolicy` varchar(512) NOT NULL DEFAULT '',
+  `callbackAcknowledgement` varchar(8) NOT NULL DEFAULT ''
+);
+
+INSERT INTO `accountsProtected` (`id`, `merchant`, `apiKey`, `viewKey`, `secretKey`, `coldWallet`, `uniqueClientId`, `invoiceExtensions`, `invoiceMaxLifetime`, `callbackEvents`, `callbackRetryPolicy`, `callbackAcknowledgement`)
+  SELECT `id`, `merchant`, `apiKey`, `viewKey`, `secretKey`, `coldWallet`, `uniqueClientId`, `invoiceExtensions`, `invoiceMaxLifetime`, `callbackEvents`, `callbackRetryPolicy`, `callbackAcknowledgement` FROM `accounts`;
+
+DROP TABLE `accounts`;
+
+ALTER TABLE `accountsProtected` RENAME TO `accounts`;
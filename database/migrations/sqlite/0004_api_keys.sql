@@ -0,0 +1,16 @@
+CREATE TABLE `apiKeys` (
+  `id` varchar(36) NOT NULL PRIMARY KEY,
+  `accountId` INTEGER NOT NULL,
+  `label` varchar(64) NOT NULL DEFAULT '',
+  `prefix` varchar(8) NOT NULL,
+  `hash` varchar(64) NOT NULL UNIQUE,
+  `scopes` varchar(255) NOT NULL,
+  `secretKey` varchar(128) NOT NULL DEFAULT '',
+  `creationTime` timestamp NOT NULL,
+  `expirationTime` timestamp NULL DEFAULT NULL,
+  `lastUsedTime` timestamp NULL DEFAULT NULL,
+  `revocationTime` timestamp NULL DEFAULT NULL
+);
+
+CREATE INDEX `apiKeys_prefix` ON `apiKeys` (`prefix`);
+CREATE INDEX `apiKeys_accountId` ON `apiKeys` (`accountId`);
@@ -0,0 +1 @@
+ALTER TABLE `accounts` ADD COLUMN `suspended` tinyint(1) NOT NULL DEFAULT 0;
@@ -0,0 +1,15 @@
+CREATE TABLE `auditLog` (
+  `sequence` integer NOT NULL PRIMARY KEY,
+  `eventTime` timestamp NOT NULL,
+  `actor` varchar(64) NOT NULL,
+  `accountId` integer NOT NULL DEFAULT 0,
+  `action` varchar(64) NOT NULL,
+  `target` varchar(255) NOT NULL,
+  `ip` varchar(45) NOT NULL,
+  `outcome` integer NOT NULL,
+  `prevHash` varchar(64) NOT NULL,
+  `hash` varchar(64) NOT NULL
+);
+
+CREATE INDEX `auditLog_accountId` ON `auditLog` (`accountId`, `sequence`);
+CREATE INDEX `auditLog_eventTime` ON `auditLog` (`eventTime`);
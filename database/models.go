@@ -1,14 +1,25 @@
 package database
 
-import "time"
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
 
 type Account struct {
-	Id         uint32 `json:"id"`
-	Merchant   string `json:"merchant"`
-	ApiKey     string `json:"apiKey"`
-	ViewKey    string `json:"viewKey"`
-	SecretKey  string `json:"secretKey"`
-	ColdWallet string `json:"coldWallet"`
+	Id                      uint32 `json:"id"`
+	Merchant                string `json:"merchant"`
+	ApiKey                  string `json:"apiKey,omitempty"`
+	ViewKey                 string `json:"viewKey,omitempty"`
+	SecretKey               string `json:"secretKey,omitempty"`
+	ColdWallet              string `json:"coldWallet"`
+	Suspended               bool   `json:"suspended"`
+	UniqueClientId          bool   `json:"uniqueClientId"`
+	InvoiceExtensions       int    `json:"invoiceExtensions"`
+	InvoiceMaxLifetime      int    `json:"invoiceMaxLifetime"`
+	CallbackEvents          string `json:"callbackEvents"`
+	CallbackRetryPolicy     string `json:"callbackRetryPolicy"`
+	CallbackAcknowledgement string `json:"callbackAcknowledgement"`
 }
 
 type InvoiceStatus string
@@ -33,6 +44,22 @@ type Invoice struct {
 	Status             InvoiceStatus `json:"status"`
 }
 
+type InvoiceHistoryAction string
+
+const (
+	InvoiceHistoryActionExtended InvoiceHistoryAction = "extended"
+	InvoiceHistoryActionRequoted InvoiceHistoryAction = "requoted"
+)
+
+type InvoiceHistory struct {
+	Id             string               `json:"id"`
+	InvoiceId      string               `json:"invoiceId"`
+	Action         InvoiceHistoryAction `json:"action"`
+	PaymentAmount  uint64               `json:"paymentAmount"`
+	ExpirationTime time.Time            `json:"expirationTime"`
+	EventTime      time.Time            `json:"eventTime"`
+}
+
 type WalletTransaction struct {
 	Id               string    `json:"id"`
 	InvoiceId        string    `json:"invoiceId"`
@@ -42,6 +69,12 @@ type WalletTransaction struct {
 	DiscoveryTime    time.Time `json:"discoveryTime"`
 }
 
+type WalletAddress struct {
+	Address  string    `json:"address"`
+	LastUsed time.Time `json:"lastUsed"`
+	InUse    bool      `json:"inUse"`
+}
+
 type CallbackStatus string
 
 const (
@@ -50,30 +83,196 @@ const (
 	CallbackStatusDelivered CallbackStatus = "delivered"
 )
 
+type CallbackSecret struct {
+	Id             string       `json:"id"`
+	AccountId      uint32       `json:"accountId"`
+	WebhookId      string       `json:"-"`
+	Secret         string       `json:"secret"`
+	CreationTime   time.Time    `json:"creationTime"`
+	ExpirationTime sql.NullTime `json:"-"`
+}
+
+type WebhookEndpoint struct {
+	Id           string    `json:"id"`
+	AccountId    uint32    `json:"accountId"`
+	Url          string    `json:"url"`
+	Events       string    `json:"events"`
+	Secret       string    `json:"secret,omitempty"`
+	Enabled      bool      `json:"enabled"`
+	CreationTime time.Time `json:"creationTime"`
+}
+
+type ApiKeyScope string
+
+const (
+	ApiKeyScopeInvoicesView   ApiKeyScope = "invoices:view"
+	ApiKeyScopeInvoicesRead   ApiKeyScope = "invoices:read"
+	ApiKeyScopeInvoicesCreate ApiKeyScope = "invoices:create"
+	ApiKeyScopeAdmin          ApiKeyScope = "admin"
+)
+
+func ApiKeyScopes() []ApiKeyScope {
+	return []ApiKeyScope{ApiKeyScopeInvoicesView,
+		ApiKeyScopeInvoicesRead,
+		ApiKeyScopeInvoicesCreate,
+		ApiKeyScopeAdmin}
+}
+
+type ApiKey struct {
+	Id             string       `json:"id"`
+	AccountId      uint32       `json:"accountId"`
+	Label          string       `json:"label"`
+	Key            string       `json:"key,omitempty"`
+	Prefix         string       `json:"prefix"`
+	Scopes         string       `json:"scopes"`
+	SecretKey      string       `json:"secretKey,omitempty"`
+	CreationTime   time.Time    `json:"creationTime"`
+	ExpirationTime sql.NullTime `json:"-"`
+	LastUsedTime   sql.NullTime `json:"-"`
+	RevocationTime sql.NullTime `json:"-"`
+}
+
+type AuditEntry struct {
+	Sequence  uint64    `json:"sequence"`
+	EventTime time.Time `json:"eventTime"`
+	Actor     string    `json:"actor"`
+	AccountId uint32    `json:"accountId"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Ip        string    `json:"ip"`
+	Outcome   int       `json:"outcome"`
+	PrevHash  string    `json:"prevHash"`
+	Hash      string    `json:"hash"`
+}
+
+// AuditFilter narrows down audit log queries, zero values match everything
+type AuditFilter struct {
+	Actor     string
+	AccountId uint32
+	Action    string
+	Since     time.Time
+	Until     time.Time
+}
+
+type CallbackEvent string
+
+const (
+	CallbackEventInvoiceCreated          CallbackEvent = "invoice.created"
+	CallbackEventInvoicePaymentDetected  CallbackEvent = "invoice.payment_detected"
+	CallbackEventInvoicePaymentConfirmed CallbackEvent = "invoice.payment_confirmed"
+	CallbackEventInvoicePaid             CallbackEvent = "invoice.paid"
+	CallbackEventInvoiceExpired          CallbackEvent = "invoice.expired"
+	CallbackEventInvoiceExtended         CallbackEvent = "invoice.extended"
+	CallbackEventInvoiceRequoted         CallbackEvent = "invoice.requoted"
+)
+
+func CallbackEvents() []CallbackEvent {
+	return []CallbackEvent{CallbackEventInvoiceCreated,
+		CallbackEventInvoicePaymentDetected,
+		CallbackEventInvoicePaymentConfirmed,
+		CallbackEventInvoicePaid,
+		CallbackEventInvoiceExpired,
+		CallbackEventInvoiceExtended,
+		CallbackEventInvoiceRequoted}
+}
+
 type Callback struct {
 	Id          string         `json:"id"`
 	InvoiceId   string         `json:"invoiceId"`
+	WebhookId   string         `json:"webhookId"`
+	Event       CallbackEvent  `json:"event"`
+	Sequence    int            `json:"sequence"`
 	RequestTime time.Time      `json:"requestTime"`
 	NextReqTime time.Time      `json:"nextReqTime"`
 	ReqErrors   int            `json:"reqErrors"`
 	Status      CallbackStatus `json:"status"`
 }
 
-func (i *Invoice) Save() error {
-	dbConnection := GetConnection()
+const (
+	CallbackAttemptBodyLimit  = 1024
+	CallbackAttemptErrorLimit = 255
+)
+
+type CallbackAttempt struct {
+	Id           string    `json:"id"`
+	CallbackId   string    `json:"callbackId"`
+	AttemptTime  time.Time `json:"attemptTime"`
+	StatusCode   int       `json:"statusCode"`
+	Latency      int64     `json:"latency"`
+	ResponseBody string    `json:"responseBody"`
+	Error        string    `json:"error"`
+}
+
+func (a *Account) SubscribesTo(event CallbackEvent) bool {
+	return subscribesTo(a.CallbackEvents, event)
+}
+
+func (w *WebhookEndpoint) SubscribesTo(event CallbackEvent) bool {
+	return subscribesTo(w.Events, event)
+}
+
+func subscribesTo(events string, event CallbackEvent) bool {
+	// Without explicit subscriptions all events are received
+	if len(events) == 0 {
+		return true
+	}
+	for _, subscribed := range strings.Split(events, ",") {
+		if CallbackEvent(subscribed) == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *ApiKey) HasScope(scope ApiKeyScope) bool {
+	for _, granted := range strings.Split(k.Scopes, ",") {
+		if ApiKeyScope(granted) == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// NewAccount returns an account with the defaults of the accounts table
+func NewAccount() Account {
+	return Account{
+		InvoiceExtensions:  3,
+		InvoiceMaxLifetime: 1440,
+		CallbackEvents:     string(CallbackEventInvoicePaid) + "," + string(CallbackEventInvoiceExpired),
+	}
+}
+
+func (r *sqlRepository) SaveAccount(account *Account) error {
+	dbConnection := r.connection()
 
-	_, err := dbConnection.Exec("INSERT INTO invoices (id, clientId, accountId, paymentAmount, paymentAddress, paymentDescription, callbackUrl, creationTime, expirationTime, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", i.Id, i.ClientId, i.AccountId, i.PaymentAmount, i.PaymentAddress, i.PaymentDescription, i.CallbackUrl, i.CreationTime, i.ExpirationTime, i.Status)
+	// Only the secret key is stored with the account, sealed
+	secretKey, err := r.envelope.seal(account.SecretKey)
 	if err != nil {
 		return err
 	}
+	query := "INSERT INTO accounts (merchant, secretKey, coldWallet, suspended, uniqueClientId, invoiceExtensions, invoiceMaxLifetime, callbackEvents, callbackRetryPolicy, callbackAcknowledgement) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	args := []any{account.Merchant, secretKey, account.ColdWallet, account.Suspended, account.UniqueClientId, account.InvoiceExtensions, account.InvoiceMaxLifetime, account.CallbackEvents, account.CallbackRetryPolicy, account.CallbackAcknowledgement}
+	if r.dialect.returningIds {
+		return dbConnection.QueryRow(query+" RETURNING id", args...).Scan(&account.Id)
+	}
+
+	result, err := dbConnection.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	account.Id = uint32(id)
 
 	return nil
 }
 
-func (i *Invoice) Update() error {
-	dbConnection := GetConnection()
+func (r *sqlRepository) UpdateAccount(account *Account) error {
+	dbConnection := r.connection()
 
-	_, err := dbConnection.Exec("UPDATE invoices SET status = ?, callbackUrl = ? WHERE id = ? ", i.Status, i.CallbackUrl, i.Id)
+	_, err := dbConnection.Exec("UPDATE accounts SET merchant = ?, coldWallet = ?, suspended = ?, uniqueClientId = ?, invoiceExtensions = ?, invoiceMaxLifetime = ?, callbackEvents = ?, callbackRetryPolicy = ?, callbackAcknowledgement = ? WHERE id = ? ", account.Merchant, account.ColdWallet, account.Suspended, account.UniqueClientId, account.InvoiceExtensions, account.InvoiceMaxLifetime, account.CallbackEvents, account.CallbackRetryPolicy, account.CallbackAcknowledgement, account.Id)
 	if err != nil {
 		return err
 	}
@@ -81,10 +280,73 @@ func (i *Invoice) Update() error {
 	return nil
 }
 
-func (w *WalletTransaction) Save() error {
-	dbConnection := GetConnection()
+func (r *sqlRepository) UpdateAccountSecretKey(account *Account) error {
+	dbConnection := r.connection()
 
-	_, err := dbConnection.Exec("INSERT INTO walletTransactions (id, invoiceId, walletAddress, paymentAmount, confirmationTime, discoveryTime) VALUES (?, ?, ?, ?, ?, ?)", w.Id, w.InvoiceId, w.WalletAddress, w.PaymentAmount, w.ConfirmationTime, w.DiscoveryTime)
+	secretKey, err := r.envelope.seal(account.SecretKey)
+	if err != nil {
+		return err
+	}
+	_, err = dbConnection.Exec("UPDATE accounts SET secretKey = ? WHERE id = ? ", secretKey, account.Id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteAccount removes a suspended account without invoices awaiting
+// payment, none are created meanwhile and none transition afterwards. Its
+// invoices are kept for the records, callbacks still outstanding for them
+// are abandoned as failed.
+func (r *sqlRepository) DeleteAccount(account *Account) error {
+	return r.transact(func(dbTx executor) error {
+		var suspended bool
+		if err := dbTx.QueryRow("SELECT suspended FROM accounts WHERE id = ?"+r.dialect.forUpdate, account.Id).Scan(&suspended); err != nil {
+			return err
+		}
+		if !suspended {
+			return ErrAccountNotSuspended
+		}
+		var pendingInvoices int
+		if err := dbTx.QueryRow("SELECT COUNT(*) FROM invoices WHERE accountId = ? AND status IN (?, ?)", account.Id, InvoiceStatusCreated, InvoiceStatusPending).Scan(&pendingInvoices); err != nil {
+			return err
+		}
+		if pendingInvoices > 0 {
+			return ErrAccountHasPendingInvoices
+		}
+
+		if _, err := dbTx.Exec("UPDATE callbacks SET status = ? WHERE status = ? AND invoiceId IN (SELECT id FROM invoices WHERE accountId = ?)", CallbackStatusFailed, CallbackStatusCreated, account.Id); err != nil {
+			return err
+		}
+		for _, query := range []string{"DELETE FROM apiKeys WHERE accountId = ?",
+			"DELETE FROM webhookEndpoints WHERE accountId = ?",
+			"DELETE FROM callbackSecrets WHERE accountId = ?",
+			"DELETE FROM accounts WHERE id = ?"} {
+			if _, err := dbTx.Exec(query, account.Id); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (r *sqlRepository) UpdateAccountCallbackEvents(account *Account) error {
+	dbConnection := r.connection()
+
+	_, err := dbConnection.Exec("UPDATE accounts SET callbackEvents = ? WHERE id = ? ", account.CallbackEvents, account.Id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *sqlRepository) UpdateAccountCallbackRetryPolicy(account *Account) error {
+	dbConnection := r.connection()
+
+	_, err := dbConnection.Exec("UPDATE accounts SET callbackRetryPolicy = ? WHERE id = ? ", account.CallbackRetryPolicy, account.Id)
 	if err != nil {
 		return err
 	}
@@ -92,10 +354,10 @@ func (w *WalletTransaction) Save() error {
 	return nil
 }
 
-func (c *Callback) Save() error {
-	dbConnection := GetConnection()
+func (r *sqlRepository) UpdateAccountCallbackAcknowledgement(account *Account) error {
+	dbConnection := r.connection()
 
-	_, err := dbConnection.Exec("INSERT INTO callbacks (id, invoiceId, requestTime, nextReqTime, reqErrors, status) VALUES (?, ?, ?, ?, ?, ?)", c.Id, c.InvoiceId, c.RequestTime, c.NextReqTime, c.ReqErrors, c.Status)
+	_, err := dbConnection.Exec("UPDATE accounts SET callbackAcknowledgement = ? WHERE id = ? ", account.CallbackAcknowledgement, account.Id)
 	if err != nil {
 		return err
 	}
@@ -103,13 +365,298 @@ func (c *Callback) Save() error {
 	return nil
 }
 
-func (c *Callback) Update() error {
-	dbConnection := GetConnection()
+func (r *sqlRepository) SaveInvoice(invoice *Invoice) error {
+	dbConnection := r.connection()
 
-	_, err := dbConnection.Exec("UPDATE callbacks SET nextReqTime = ?, reqErrors = ?, status = ? WHERE id = ? ", c.NextReqTime, c.ReqErrors, c.Status, c.Id)
+	_, err := dbConnection.Exec("INSERT INTO invoices (id, clientId, accountId, paymentAmount, paymentAddress, paymentDescription, callbackUrl, creationTime, expirationTime, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", invoice.Id, invoice.ClientId, invoice.AccountId, invoice.PaymentAmount, invoice.PaymentAddress, invoice.PaymentDescription, invoice.CallbackUrl, invoice.CreationTime, invoice.ExpirationTime, invoice.Status)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// TransitionInvoice moves the invoice on from its current status, failing
+// when another process changed the status in the meantime
+func (r *sqlRepository) TransitionInvoice(invoice *Invoice, status InvoiceStatus) error {
+	dbConnection := r.connection()
+
+	result, err := dbConnection.Exec("UPDATE invoices SET status = ? WHERE id = ? AND status = ?", status, invoice.Id, invoice.Status)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return ErrInvoiceStatusChanged
+	}
+	invoice.Status = status
+
+	return nil
+}
+
+func (r *sqlRepository) UpdateInvoiceQuote(invoice *Invoice) error {
+	dbConnection := r.connection()
+
+	// Only invoices still awaiting payment may be re-quoted
+	result, err := dbConnection.Exec("UPDATE invoices SET paymentAmount = ?, expirationTime = ? WHERE id = ? AND status IN (?, ?)", invoice.PaymentAmount, invoice.ExpirationTime, invoice.Id, InvoiceStatusCreated, InvoiceStatusPending)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return ErrInvoiceNotPending
+	}
+
+	return nil
+}
+
+func (r *sqlRepository) SaveInvoiceHistory(entry *InvoiceHistory) error {
+	dbConnection := r.connection()
+
+	_, err := dbConnection.Exec("INSERT INTO invoiceHistory (id, invoiceId, action, paymentAmount, expirationTime, eventTime) VALUES (?, ?, ?, ?, ?, ?)", entry.Id, entry.InvoiceId, entry.Action, entry.PaymentAmount, entry.ExpirationTime, entry.EventTime)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *sqlRepository) SaveWalletTransaction(walletTransaction *WalletTransaction) error {
+	dbConnection := r.connection()
+
+	_, err := dbConnection.Exec("INSERT INTO walletTransactions (id, invoiceId, walletAddress, paymentAmount, confirmationTime, discoveryTime) VALUES (?, ?, ?, ?, ?, ?)", walletTransaction.Id, walletTransaction.InvoiceId, walletTransaction.WalletAddress, walletTransaction.PaymentAmount, walletTransaction.ConfirmationTime, walletTransaction.DiscoveryTime)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *sqlRepository) SaveWalletAddress(address string) error {
+	dbConnection := r.connection()
+
+	_, err := dbConnection.Exec("INSERT INTO walletAddresses (address) VALUES (?)", address)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *sqlRepository) DeleteInvoice(invoice *Invoice) error {
+	dbConnection := r.connection()
+
+	for _, query := range []string{"DELETE FROM callbackAttempts WHERE callbackId IN (SELECT id FROM callbacks WHERE invoiceId = ?)",
+		"DELETE FROM callbacks WHERE invoiceId = ?",
+		"DELETE FROM invoiceHistory WHERE invoiceId = ?",
+		"DELETE FROM walletTransactions WHERE invoiceId = ?",
+		"DELETE FROM invoices WHERE id = ?"} {
+		if _, err := dbConnection.Exec(query, invoice.Id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *sqlRepository) DeleteCallback(callback *Callback) error {
+	dbConnection := r.connection()
+
+	for _, query := range []string{"DELETE FROM callbackAttempts WHERE callbackId = ?",
+		"DELETE FROM callbacks WHERE id = ?"} {
+		if _, err := dbConnection.Exec(query, callback.Id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *sqlRepository) AppendAuditEntry(entry *AuditEntry) error {
+	dbConnection := r.connection()
+
+	// Hashes cover the entry as stored, request derived text is cut to fit
+	entry.EventTime = entry.EventTime.UTC().Truncate(time.Second)
+	entry.Actor = truncateText(entry.Actor, auditActorLimit)
+	entry.Action = truncateText(entry.Action, auditActionLimit)
+	entry.Target = truncateText(entry.Target, auditTargetLimit)
+	entry.Ip = truncateText(entry.Ip, auditIpLimit)
+
+	// Entries chain onto the latest one, instances appending concurrently
+	// collide on the sequence and retry onto the winner
+	var err error
+	for attempt := 0; attempt < auditAppendAttempts; attempt++ {
+		var sequence uint64
+		var prevHash string
+		err = dbConnection.QueryRow("SELECT sequence, hash FROM auditLog ORDER BY sequence DESC LIMIT 1").Scan(&sequence, &prevHash)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		entry.Sequence = sequence + 1
+		entry.PrevHash = prevHash
+		entry.Hash = entry.ComputeHash()
+
+		_, err = dbConnection.Exec("INSERT INTO auditLog (sequence, eventTime, actor, accountId, action, target, ip, outcome, prevHash, hash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", entry.Sequence, entry.EventTime, entry.Actor, entry.AccountId, entry.Action, entry.Target, entry.Ip, entry.Outcome, entry.PrevHash, entry.Hash)
+		if err == nil || !isUniqueViolation(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+func (r *sqlRepository) SaveCallback(callback *Callback) error {
+	dbConnection := r.connection()
+
+	_, err := dbConnection.Exec(r.dialect.callbackInsert, callback.Id, callback.InvoiceId, callback.WebhookId, callback.Event, callback.RequestTime, callback.NextReqTime, callback.ReqErrors, callback.Status, callback.InvoiceId, callback.WebhookId)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *sqlRepository) UpdateCallback(callback *Callback) error {
+	dbConnection := r.connection()
+
+	_, err := dbConnection.Exec("UPDATE callbacks SET nextReqTime = ?, reqErrors = ?, status = ? WHERE id = ? ", callback.NextReqTime, callback.ReqErrors, callback.Status, callback.Id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *sqlRepository) SaveCallbackSecret(callbackSecret *CallbackSecret) error {
+	dbConnection := r.connection()
+
+	secret, err := r.envelope.seal(callbackSecret.Secret)
+	if err != nil {
+		return err
+	}
+	_, err = dbConnection.Exec("INSERT INTO callbackSecrets (id, accountId, webhookId, secret, creationTime, expirationTime) VALUES (?, ?, ?, ?, ?, ?)", callbackSecret.Id, callbackSecret.AccountId, callbackSecret.WebhookId, secret, callbackSecret.CreationTime, callbackSecret.ExpirationTime)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (a CallbackAttempt) WithError(err error) CallbackAttempt {
+	if err != nil {
+		a.Error = truncateText(err.Error(), CallbackAttemptErrorLimit)
+	}
+	return a
+}
+
+// truncateText cuts text to the characters a varchar column of limit holds,
+// dropping invalid UTF-8 the column would reject
+func truncateText(text string, limit int) string {
+	text = strings.ToValidUTF8(text, "")
+	for offset := range text {
+		if limit == 0 {
+			return text[:offset]
+		}
+		limit--
+	}
+	return text
+}
+
+func (r *sqlRepository) SaveCallbackAttempt(callbackAttempt *CallbackAttempt) error {
+	dbConnection := r.connection()
+
+	_, err := dbConnection.Exec("INSERT INTO callbackAttempts (id, callbackId, attemptTime, statusCode, latency, responseBody, error) VALUES (?, ?, ?, ?, ?, ?, ?)", callbackAttempt.Id, callbackAttempt.CallbackId, callbackAttempt.AttemptTime, callbackAttempt.StatusCode, callbackAttempt.Latency, callbackAttempt.ResponseBody, callbackAttempt.Error)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *sqlRepository) SaveApiKey(apiKey *ApiKey) error {
+	dbConnection := r.connection()
+
+	// Only the hash of the key is stored, the key itself is shown once. Keys
+	// without a secret of their own sign with the account's secretKey.
+	apiKey.Prefix = KeyPrefix(apiKey.Key)
+	var secretKey string
+	if len(apiKey.SecretKey) > 0 {
+		var err error
+		if secretKey, err = r.envelope.seal(apiKey.SecretKey); err != nil {
+			return err
+		}
+	}
+	_, err := dbConnection.Exec("INSERT INTO apiKeys (id, accountId, label, prefix, hash, scopes, secretKey, creationTime, expirationTime) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", apiKey.Id, apiKey.AccountId, apiKey.Label, apiKey.Prefix, HashKey(apiKey.Key), apiKey.Scopes, secretKey, apiKey.CreationTime, apiKey.ExpirationTime)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *sqlRepository) TouchApiKey(apiKey *ApiKey) error {
+	dbConnection := r.connection()
+
+	// Record usage at most once a minute to spare writes on every request
+	now := time.Now()
+	_, err := dbConnection.Exec("UPDATE apiKeys SET lastUsedTime = ? WHERE id = ? AND (lastUsedTime IS NULL OR lastUsedTime < ?)", now, apiKey.Id, now.Add(-time.Minute))
+	if err != nil {
+		return err
+	}
+	apiKey.LastUsedTime = sql.NullTime{Time: now, Valid: true}
+
+	return nil
+}
+
+func (r *sqlRepository) RevokeApiKey(apiKey *ApiKey) error {
+	dbConnection := r.connection()
+
+	apiKey.RevocationTime = sql.NullTime{Time: time.Now(), Valid: true}
+	_, err := dbConnection.Exec("UPDATE apiKeys SET revocationTime = ? WHERE id = ? AND revocationTime IS NULL", apiKey.RevocationTime, apiKey.Id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *sqlRepository) SaveWebhookEndpoint(webhookEndpoint *WebhookEndpoint) error {
+	dbConnection := r.connection()
+
+	secret, err := r.envelope.seal(webhookEndpoint.Secret)
+	if err != nil {
+		return err
+	}
+	_, err = dbConnection.Exec("INSERT INTO webhookEndpoints (id, accountId, url, events, secret, enabled, creationTime) VALUES (?, ?, ?, ?, ?, ?, ?)", webhookEndpoint.Id, webhookEndpoint.AccountId, webhookEndpoint.Url, webhookEndpoint.Events, secret, webhookEndpoint.Enabled, webhookEndpoint.CreationTime)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *sqlRepository) UpdateWebhookEndpoint(webhookEndpoint *WebhookEndpoint) error {
+	dbConnection := r.connection()
+
+	secret, err := r.envelope.seal(webhookEndpoint.Secret)
+	if err != nil {
+		return err
+	}
+	_, err = dbConnection.Exec("UPDATE webhookEndpoints SET url = ?, events = ?, secret = ?, enabled = ? WHERE id = ? ", webhookEndpoint.Url, webhookEndpoint.Events, secret, webhookEndpoint.Enabled, webhookEndpoint.Id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *sqlRepository) DeleteWebhookEndpoint(webhookEndpoint *WebhookEndpoint) error {
+	dbConnection := r.connection()
+
+	for _, query := range []string{"DELETE FROM callbackSecrets WHERE webhookId = ?",
+		"DELETE FROM webhookEndpoints WHERE id = ?"} {
+		if _, err := dbConnection.Exec(query, webhookEndpoint.Id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package database
+
+import (
+	"time"
+)
+
+type AccountRepository interface {
+	FetchAccountById(id uint32) (Account, error)
+	FetchAccounts() ([]Account, error)
+	LockAccount(id uint32) error
+	SaveAccount(account *Account) error
+	UpdateAccount(account *Account) error
+	UpdateAccountSecretKey(account *Account) error
+	DeleteAccount(account *Account) error
+	UpdateAccountCallbackEvents(account *Account) error
+	UpdateAccountCallbackRetryPolicy(account *Account) error
+	UpdateAccountCallbackAcknowledgement(account *Account) error
+}
+
+type ApiKeyRepository interface {
+	FetchActiveApiKey(key string) (ApiKey, error)
+	FetchApiKeyById(id string) (ApiKey, error)
+	FetchApiKeysByAccountId(accountId uint32) ([]ApiKey, error)
+	SaveApiKey(apiKey *ApiKey) error
+	TouchApiKey(apiKey *ApiKey) error
+	RevokeApiKey(apiKey *ApiKey) error
+}
+
+type InvoiceRepository interface {
+	FetchInvoiceById(id string) (Invoice, error)
+	FetchInvoiceByClientId(accountId uint32, clientId string) (Invoice, error)
+	LockInvoice(id string) (Invoice, error)
+	FetchPendingInvoices() ([]Invoice, error)
+	FetchPendingInvoiceCountByAccountId(accountId uint32) (int, error)
+	FetchInvoiceHistoryByInvoiceId(invoiceId string) ([]InvoiceHistory, error)
+	SaveInvoice(invoice *Invoice) error
+	TransitionInvoice(invoice *Invoice, status InvoiceStatus) error
+	UpdateInvoiceQuote(invoice *Invoice) error
+	SaveInvoiceHistory(entry *InvoiceHistory) error
+}
+
+type AddressRepository interface {
+	FetchWalletAddresses() ([]string, error)
+	FetchWalletAddressStates() ([]WalletAddress, error)
+	FetchLRUWalletAddress() (string, error)
+	FetchLRUWalletAddresses(count int) ([]string, error)
+	ReleaseLRUWalletAddress(address string) error
+	SaveWalletAddress(address string) error
+}
+
+type WalletTransactionRepository interface {
+	FetchWalletTransactionsByInvoiceId(invoiceId string) ([]WalletTransaction, error)
+	FetchPaymentAmountSumForInvoiceId(invoiceId string) (uint64, error)
+	SaveWalletTransaction(walletTransaction *WalletTransaction) error
+}
+
+type CallbackRepository interface {
+	FetchCallbacksByInvoiceId(invoiceId string) ([]Callback, error)
+	FetchCallbackById(id string) (Callback, error)
+	FetchCallbacksByAccountId(accountId uint32, status CallbackStatus, limit int, offset int) ([]Callback, error)
+	FetchCallbackAttemptsByCallbackId(callbackId string) ([]CallbackAttempt, error)
+	ClaimPendingCallbacks(limit int, lease time.Duration) ([]Callback, error)
+	ReleaseCallbackClaim(id string) error
+	SaveCallback(callback *Callback) error
+	UpdateCallback(callback *Callback) error
+	SaveCallbackAttempt(callbackAttempt *CallbackAttempt) error
+	FetchActiveCallbackSecrets(accountId uint32) ([]CallbackSecret, error)
+	ExpireCallbackSecrets(accountId uint32, expirationTime time.Time) error
+	SaveCallbackSecret(callbackSecret *CallbackSecret) error
+	FetchActiveWebhookSecrets(webhookId string) ([]CallbackSecret, error)
+	ExpireWebhookSecrets(webhookId string, expirationTime time.Time) error
+	FetchWebhookEndpointById(id string) (WebhookEndpoint, error)
+	FetchWebhookEndpointsByAccountId(accountId uint32) ([]WebhookEndpoint, error)
+	SaveWebhookEndpoint(webhookEndpoint *WebhookEndpoint) error
+	UpdateWebhookEndpoint(webhookEndpoint *WebhookEndpoint) error
+	DeleteWebhookEndpoint(webhookEndpoint *WebhookEndpoint) error
+}
+
+// RetentionRepository finds and removes settled records once they are no
+// longer needed in the hot tables
+type RetentionRepository interface {
+	FetchSettledInvoicesBefore(status InvoiceStatus, before time.Time, limit int, offset int) ([]Invoice, error)
+	FetchSettledCallbacksBefore(before time.Time, limit int, offset int) ([]Callback, error)
+	DeleteInvoice(invoice *Invoice) error
+	DeleteCallback(callback *Callback) error
+}
+
+// AuditRepository only ever appends, entries are never updated or removed
+type AuditRepository interface {
+	FetchAuditEntries(filter AuditFilter, limit int, offset int) ([]AuditEntry, error)
+	FetchAuditEntriesAfter(sequence uint64, limit int) ([]AuditEntry, error)
+	AppendAuditEntry(entry *AuditEntry) error
+}
+
+type Repositories interface {
+	AccountRepository
+	ApiKeyRepository
+	InvoiceRepository
+	AddressRepository
+	WalletTransactionRepository
+	CallbackRepository
+	RetentionRepository
+	AuditRepository
+}
+
+// UnitOfWork groups writes which have to commit atomically, such as an
+// invoice status transition, the release of its payment address and the
+// callbacks it triggers. Callbacks are only enqueued once the unit of work
+// commits, the callbacks table acting as transactional outbox.
+type UnitOfWork interface {
+	Repositories
+	AfterCommit(f func())
+}
+
+// Store is the repositories of a database backend, injected into the servers
+type Store interface {
+	Repositories
+	InUnitOfWork(work func(uow UnitOfWork) error) error
+	Healthy() bool
+	Close() error
+}
@@ -0,0 +1,344 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestStore opens a migrated SQLite store of its own for a test
+func newTestStore(t *testing.T) *sqlStore {
+	t.Helper()
+	dataSourceName := fmt.Sprintf("file:%s?_txlock=immediate&_busy_timeout=10000", filepath.Join(t.TempDir(), "pkt-checkout.db"))
+	db, err := sql.Open(sqliteDialect.driver, dataSourceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err = migrate(db, &sqliteDialect, true); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	envelope, err := newEnvelope(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newSqlStore(db, &sqliteDialect, envelope)
+}
+
+func saveTestInvoice(t *testing.T, store *sqlStore, accountId uint32, id string, status InvoiceStatus) Invoice {
+	t.Helper()
+	invoice := Invoice{
+		Id:             id,
+		AccountId:      accountId,
+		PaymentAmount:  10,
+		PaymentAddress: "pkt1q" + id,
+		CreationTime:   time.Now(),
+		ExpirationTime: time.Now().Add(time.Hour),
+		Status:         status,
+	}
+	if err := store.SaveInvoice(&invoice); err != nil {
+		t.Fatalf("saving invoice: %v", err)
+	}
+	return invoice
+}
+
+func TestTransitionInvoice(t *testing.T) {
+	store := newTestStore(t)
+	invoice := saveTestInvoice(t, store, 1, "invoice-1", InvoiceStatusCreated)
+
+	// Another process moved the invoice on in the meantime
+	stale := invoice
+	if err := store.TransitionInvoice(&invoice, InvoiceStatusPending); err != nil {
+		t.Fatalf("transitioning: %v", err)
+	}
+	if invoice.Status != InvoiceStatusPending {
+		t.Fatalf("invoice status is %s, want %s", invoice.Status, InvoiceStatusPending)
+	}
+	if err := store.TransitionInvoice(&stale, InvoiceStatusExpired); err != ErrInvoiceStatusChanged {
+		t.Fatalf("transitioning a stale invoice: got %v, want %v", err, ErrInvoiceStatusChanged)
+	}
+	if stale.Status != InvoiceStatusCreated {
+		t.Fatalf("stale invoice status is %s, want %s", stale.Status, InvoiceStatusCreated)
+	}
+
+	stored, err := store.FetchInvoiceById(invoice.Id)
+	if err != nil {
+		t.Fatalf("fetching invoice: %v", err)
+	}
+	if stored.Status != InvoiceStatusPending {
+		t.Fatalf("stored status is %s, want %s", stored.Status, InvoiceStatusPending)
+	}
+
+	// Unknown invoices have no status to move on from either
+	unknown := Invoice{Id: "invoice-2", Status: InvoiceStatusCreated}
+	if err := store.TransitionInvoice(&unknown, InvoiceStatusPaid); err != ErrInvoiceStatusChanged {
+		t.Fatalf("transitioning an unknown invoice: got %v, want %v", err, ErrInvoiceStatusChanged)
+	}
+}
+
+func TestFetchLRUWalletAddresses(t *testing.T) {
+	store := newTestStore(t)
+	for _, address := range []string{"pkt1qa", "pkt1qb", "pkt1qc"} {
+		if err := store.SaveWalletAddress(address); err != nil {
+			t.Fatalf("saving address: %v", err)
+		}
+	}
+	if _, err := store.db.Exec("UPDATE walletAddresses SET lastUsed = ? WHERE address = ?", time.Now().UTC().Add(-time.Hour), "pkt1qb"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.db.Exec("UPDATE walletAddresses SET lastUsed = ? WHERE address = ?", time.Now().UTC(), "pkt1qa"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Least recently used addresses first, locked once fetched
+	addresses, err := store.FetchLRUWalletAddresses(2)
+	if err != nil {
+		t.Fatalf("fetching addresses: %v", err)
+	}
+	if len(addresses) != 2 || addresses[0] != "pkt1qc" || addresses[1] != "pkt1qb" {
+		t.Fatalf("fetched %q, want [pkt1qc pkt1qb]", addresses)
+	}
+
+	// All or nothing, the remaining address stays available
+	if _, err := store.FetchLRUWalletAddresses(2); err != ErrInsufficientWalletAddresses {
+		t.Fatalf("fetching too many addresses: got %v, want %v", err, ErrInsufficientWalletAddresses)
+	}
+	var inUse int
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM walletAddresses WHERE inUse = ?", true).Scan(&inUse); err != nil {
+		t.Fatal(err)
+	}
+	if inUse != 2 {
+		t.Fatalf("%d addresses in use, want 2", inUse)
+	}
+	address, err := store.FetchLRUWalletAddress()
+	if err != nil || address != "pkt1qa" {
+		t.Fatalf("fetching last address: got %q, %v", address, err)
+	}
+	if _, err := store.FetchLRUWalletAddress(); err != sql.ErrNoRows {
+		t.Fatalf("fetching from an exhausted pool: got %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func TestSaveCallbackSequence(t *testing.T) {
+	store := newTestStore(t)
+	saveTestInvoice(t, store, 1, "invoice-1", InvoiceStatusCreated)
+	saveTestInvoice(t, store, 1, "invoice-2", InvoiceStatusCreated)
+
+	// Sequences count per invoice and webhook endpoint
+	callbacks := []struct {
+		id        string
+		invoiceId string
+		webhookId string
+		event     CallbackEvent
+		sequence  int
+	}{
+		{"callback-1", "invoice-1", "", CallbackEventInvoiceCreated, 1},
+		{"callback-2", "invoice-1", "", CallbackEventInvoicePaid, 2},
+		{"callback-3", "invoice-1", "webhook-1", CallbackEventInvoicePaid, 1},
+		{"callback-4", "invoice-2", "", CallbackEventInvoiceExpired, 1},
+		{"callback-5", "invoice-1", "", CallbackEventInvoiceExpired, 3},
+	}
+	for _, c := range callbacks {
+		callback := Callback{
+			Id:          c.id,
+			InvoiceId:   c.invoiceId,
+			WebhookId:   c.webhookId,
+			Event:       c.event,
+			RequestTime: time.Now(),
+			NextReqTime: time.Now(),
+			Status:      CallbackStatusCreated,
+		}
+		if err := store.InUnitOfWork(func(uow UnitOfWork) error {
+			return uow.SaveCallback(&callback)
+		}); err != nil {
+			t.Fatalf("saving %s: %v", c.id, err)
+		}
+	}
+
+	for _, c := range callbacks {
+		callback, err := store.FetchCallbackById(c.id)
+		if err != nil {
+			t.Fatalf("fetching %s: %v", c.id, err)
+		}
+		if callback.Sequence != c.sequence || callback.Event != c.event {
+			t.Errorf("%s is %s #%d, want %s #%d", c.id, callback.Event, callback.Sequence, c.event, c.sequence)
+		}
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	store := newTestStore(t)
+	account := Account{Merchant: "merchant", SecretKey: "secret", ColdWallet: "pkt1qcold", InvoiceExtensions: 3, InvoiceMaxLifetime: 1440}
+	if err := store.SaveAccount(&account); err != nil {
+		t.Fatalf("saving account: %v", err)
+	}
+	invoice := saveTestInvoice(t, store, account.Id, "invoice-1", InvoiceStatusPending)
+	for _, callback := range []Callback{
+		{Id: "callback-1", InvoiceId: invoice.Id, Event: CallbackEventInvoiceCreated, Status: CallbackStatusDelivered},
+		{Id: "callback-2", InvoiceId: invoice.Id, Event: CallbackEventInvoicePaid, Status: CallbackStatusCreated},
+	} {
+		callback.RequestTime = time.Now()
+		callback.NextReqTime = time.Now()
+		if err := store.SaveCallback(&callback); err != nil {
+			t.Fatalf("saving callback: %v", err)
+		}
+	}
+
+	// Active accounts and ones with invoices awaiting payment stay
+	if err := store.DeleteAccount(&account); err != ErrAccountNotSuspended {
+		t.Fatalf("deleting an active account: got %v, want %v", err, ErrAccountNotSuspended)
+	}
+	account.Suspended = true
+	if err := store.UpdateAccount(&account); err != nil {
+		t.Fatalf("suspending account: %v", err)
+	}
+	if err := store.DeleteAccount(&account); err != ErrAccountHasPendingInvoices {
+		t.Fatalf("deleting an account with a pending invoice: got %v, want %v", err, ErrAccountHasPendingInvoices)
+	}
+	if _, err := store.FetchAccountById(account.Id); err != nil {
+		t.Fatalf("fetching refused account: %v", err)
+	}
+
+	// Settled accounts go, their invoices stay without callbacks outstanding
+	if err := store.TransitionInvoice(&invoice, InvoiceStatusPaid); err != nil {
+		t.Fatalf("transitioning invoice: %v", err)
+	}
+	if err := store.DeleteAccount(&account); err != nil {
+		t.Fatalf("deleting account: %v", err)
+	}
+	if _, err := store.FetchAccountById(account.Id); err != sql.ErrNoRows {
+		t.Fatalf("fetching deleted account: got %v, want %v", err, sql.ErrNoRows)
+	}
+	if _, err := store.FetchInvoiceById(invoice.Id); err != nil {
+		t.Fatalf("fetching invoice of deleted account: %v", err)
+	}
+	for id, status := range map[string]CallbackStatus{"callback-1": CallbackStatusDelivered, "callback-2": CallbackStatusFailed} {
+		callback, err := store.FetchCallbackById(id)
+		if err != nil {
+			t.Fatalf("fetching %s: %v", id, err)
+		}
+		if callback.Status != status {
+			t.Errorf("%s is %s, want %s", id, callback.Status, status)
+		}
+	}
+}
+
+func TestAppendAuditEntry(t *testing.T) {
+	store := newTestStore(t)
+	for _, action := range []string{"POST /v1/invoice/create", "DELETE /v1/webhooks/:id"} {
+		entry := AuditEntry{EventTime: time.Now(), Actor: "admin", Action: action, Target: "/v1/invoice/create", Ip: "127.0.0.1", Outcome: 200}
+		if err := store.AppendAuditEntry(&entry); err != nil {
+			t.Fatalf("appending entry: %v", err)
+		}
+	}
+	verification, err := VerifyAuditLog(store)
+	if err != nil || !verification.Verified || verification.Entries != 2 {
+		t.Fatalf("verifying audit log: got %+v, %v", verification, err)
+	}
+
+	// Only sequence collisions are worth retrying
+	_, err = store.db.Exec("INSERT INTO auditLog (sequence, eventTime, actor, accountId, action, target, ip, outcome, prevHash, hash) VALUES (1, ?, '', 0, '', '', '', 0, '', '')", time.Now().UTC())
+	if !isUniqueViolation(err) {
+		t.Fatalf("duplicate sequence not reported as unique violation: %v", err)
+	}
+	_, err = store.db.Exec("INSERT INTO auditLog (sequence) VALUES (3)")
+	if err == nil || isUniqueViolation(err) {
+		t.Fatalf("missing columns reported as unique violation: %v", err)
+	}
+}
+
+func TestWebhookSecrets(t *testing.T) {
+	store := newTestStore(t)
+	webhookEndpoint := WebhookEndpoint{Id: "webhook-1", AccountId: 1, Url: "https://example.com/webhook", Secret: "current", Enabled: true, CreationTime: time.Now()}
+	if err := store.SaveWebhookEndpoint(&webhookEndpoint); err != nil {
+		t.Fatalf("saving webhook endpoint: %v", err)
+	}
+	for _, callbackSecret := range []CallbackSecret{
+		{Id: "secret-1", AccountId: 1, Secret: "account"},
+		{Id: "secret-2", AccountId: 1, WebhookId: webhookEndpoint.Id, Secret: "previous", ExpirationTime: sql.NullTime{Time: time.Now().Add(time.Hour), Valid: true}},
+		{Id: "secret-3", AccountId: 1, WebhookId: webhookEndpoint.Id, Secret: "expired", ExpirationTime: sql.NullTime{Time: time.Now().Add(-time.Hour), Valid: true}},
+	} {
+		callbackSecret.CreationTime = time.Now()
+		if err := store.SaveCallbackSecret(&callbackSecret); err != nil {
+			t.Fatalf("saving callback secret: %v", err)
+		}
+	}
+
+	// Account and webhook endpoint secrets don't mix
+	accountSecrets, err := store.FetchActiveCallbackSecrets(1)
+	if err != nil || len(accountSecrets) != 1 || accountSecrets[0].Secret != "account" {
+		t.Fatalf("fetching account secrets: got %+v, %v", accountSecrets, err)
+	}
+	webhookSecrets, err := store.FetchActiveWebhookSecrets(webhookEndpoint.Id)
+	if err != nil || len(webhookSecrets) != 1 || webhookSecrets[0].Secret != "previous" {
+		t.Fatalf("fetching webhook secrets: got %+v, %v", webhookSecrets, err)
+	}
+
+	// Expiring the webhook endpoint's secrets leaves the account's alone
+	if err := store.ExpireWebhookSecrets(webhookEndpoint.Id, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("expiring webhook secrets: %v", err)
+	}
+	if webhookSecrets, err = store.FetchActiveWebhookSecrets(webhookEndpoint.Id); err != nil || len(webhookSecrets) != 0 {
+		t.Fatalf("fetching expired webhook secrets: got %+v, %v", webhookSecrets, err)
+	}
+	if accountSecrets, err = store.FetchActiveCallbackSecrets(1); err != nil || len(accountSecrets) != 1 {
+		t.Fatalf("fetching account secrets: got %+v, %v", accountSecrets, err)
+	}
+
+	// Removing the webhook endpoint removes its secrets
+	if err := store.DeleteWebhookEndpoint(&webhookEndpoint); err != nil {
+		t.Fatalf("deleting webhook endpoint: %v", err)
+	}
+	var remaining int
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM callbackSecrets WHERE webhookId = ?", webhookEndpoint.Id).Scan(&remaining); err != nil {
+		t.Fatal(err)
+	}
+	if remaining != 0 {
+		t.Fatalf("%d secrets of the deleted webhook endpoint remain", remaining)
+	}
+}
+
+func TestApiKeySecretKey(t *testing.T) {
+	store := newTestStore(t)
+	for _, apiKey := range []ApiKey{
+		{Id: "key-1", AccountId: 1, Key: "0b9c6a8e-account", Scopes: joinScopes(ApiKeyScopes())},
+		{Id: "key-2", AccountId: 1, Key: "5e2d7f3c-scoped", Scopes: string(ApiKeyScopeInvoicesRead), SecretKey: "scoped-secret"},
+	} {
+		apiKey.CreationTime = time.Now()
+		if err := store.SaveApiKey(&apiKey); err != nil {
+			t.Fatalf("saving %s: %v", apiKey.Id, err)
+		}
+	}
+
+	// Secrets are sealed at rest and opened for the key authenticating
+	var sealed string
+	if err := store.db.QueryRow("SELECT secretKey FROM apiKeys WHERE id = ?", "key-2").Scan(&sealed); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, sealedValuePrefix) {
+		t.Fatalf("secret key stored as %q", sealed)
+	}
+	for key, secretKey := range map[string]string{"0b9c6a8e-account": "", "5e2d7f3c-scoped": "scoped-secret"} {
+		apiKey, err := store.FetchActiveApiKey(key)
+		if err != nil {
+			t.Fatalf("fetching %s: %v", key, err)
+		}
+		if apiKey.SecretKey != secretKey {
+			t.Errorf("%s has secret key %q, want %q", key, apiKey.SecretKey, secretKey)
+		}
+	}
+
+	// Listing keys never reveals their secrets
+	apiKeys, err := store.FetchApiKeysByAccountId(1)
+	if err != nil || len(apiKeys) != 2 {
+		t.Fatalf("fetching keys: got %d, %v", len(apiKeys), err)
+	}
+	for _, apiKey := range apiKeys {
+		if len(apiKey.SecretKey) > 0 {
+			t.Errorf("listing reveals the secret key of %s", apiKey.Id)
+		}
+	}
+}
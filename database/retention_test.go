@@ -0,0 +1,200 @@
+package database_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"pkt-checkout/database"
+	"pkt-checkout/retention"
+	"testing"
+	"time"
+)
+
+// saveSettledInvoices stores invoices which expired two years ago, with a
+// transaction, a history entry and a delivered callback each
+func saveSettledInvoices(t *testing.T, store database.Store, prefix string, count int, status database.InvoiceStatus) {
+	t.Helper()
+	expiration := time.Now().AddDate(-2, 0, 0)
+	err := store.InUnitOfWork(func(uow database.UnitOfWork) error {
+		for i := 0; i < count; i++ {
+			invoice := database.Invoice{
+				Id:             fmt.Sprintf("%s-%d", prefix, i),
+				AccountId:      1,
+				PaymentAmount:  10,
+				PaymentAddress: "pkt1qaddress",
+				CreationTime:   expiration.Add(-time.Hour),
+				ExpirationTime: expiration,
+				Status:         status,
+			}
+			if err := uow.SaveInvoice(&invoice); err != nil {
+				return err
+			}
+			if err := uow.SaveWalletTransaction(&database.WalletTransaction{Id: invoice.Id + "-tx", InvoiceId: invoice.Id, WalletAddress: invoice.PaymentAddress, PaymentAmount: 10, ConfirmationTime: expiration, DiscoveryTime: expiration}); err != nil {
+				return err
+			}
+			if err := uow.SaveInvoiceHistory(&database.InvoiceHistory{Id: invoice.Id + "-history", InvoiceId: invoice.Id, Action: database.InvoiceHistoryActionExtended, PaymentAmount: 10, ExpirationTime: expiration, EventTime: expiration}); err != nil {
+				return err
+			}
+			if err := uow.SaveCallback(&database.Callback{Id: invoice.Id + "-callback", InvoiceId: invoice.Id, Event: database.CallbackEventInvoicePaid, RequestTime: expiration, NextReqTime: expiration, Status: database.CallbackStatusDelivered}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("saving invoices: %v", err)
+	}
+}
+
+func countInvoices(t *testing.T, store database.Store, status database.InvoiceStatus) int {
+	t.Helper()
+	invoices, err := store.FetchSettledInvoicesBefore(status, time.Now(), 10000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(invoices)
+}
+
+func TestRetentionDryRun(t *testing.T) {
+	store := database.NewTestStore(t)
+
+	// More expired invoices than fit a batch, dry runs have to page past them
+	saveSettledInvoices(t, store, "expired", 520, database.InvoiceStatusExpired)
+	saveSettledInvoices(t, store, "paid", 3, database.InvoiceStatusPaid)
+	server := retention.Server{
+		Database:           store,
+		ExpiredInvoiceDays: 30,
+		PaidInvoiceMonths:  12,
+		CallbackDays:       30,
+		ArchivePath:        filepath.Join(t.TempDir(), "archive"),
+		DryRun:             true,
+	}
+
+	report, err := server.Run(time.Now())
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if report.PurgedInvoices != 520 || report.ArchivedInvoices != 3 || len(report.Archive) > 0 {
+		t.Fatalf("dry run reported %+v", report)
+	}
+	if expired, paid := countInvoices(t, store, database.InvoiceStatusExpired), countInvoices(t, store, database.InvoiceStatusPaid); expired != 520 || paid != 3 {
+		t.Fatalf("dry run left %d expired and %d paid invoices of 520 and 3", expired, paid)
+	}
+	if _, err := os.Stat(server.ArchivePath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("dry run created the archive directory: %v", err)
+	}
+
+	// The real run removes what the dry run counted
+	server.DryRun = false
+	report, err = server.Run(time.Now())
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if report.PurgedInvoices != 520 || report.ArchivedInvoices != 3 || len(report.Archive) == 0 {
+		t.Fatalf("run reported %+v", report)
+	}
+	if expired, paid := countInvoices(t, store, database.InvoiceStatusExpired), countInvoices(t, store, database.InvoiceStatusPaid); expired != 0 || paid != 0 {
+		t.Fatalf("run left %d expired and %d paid invoices", expired, paid)
+	}
+	if _, err := store.FetchCallbackById("expired-0-callback"); err != sql.ErrNoRows {
+		t.Fatalf("fetching callback of purged invoice: got %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func TestRetentionArchive(t *testing.T) {
+	store := database.NewTestStore(t)
+	saveSettledInvoices(t, store, "paid", 2, database.InvoiceStatusPaid)
+	server := retention.Server{
+		Database:          store,
+		PaidInvoiceMonths: 12,
+		ArchivePath:       filepath.Join(t.TempDir(), "archive"),
+	}
+
+	report, err := server.Run(time.Now())
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if report.ArchivedInvoices != 2 {
+		t.Fatalf("archived %d invoices, want 2", report.ArchivedInvoices)
+	}
+
+	// Every line holds an invoice with everything removed along with it
+	file, err := os.Open(report.Archive)
+	if err != nil {
+		t.Fatalf("opening archive: %v", err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("reading archive: %v", err)
+	}
+	scanner := bufio.NewScanner(reader)
+	archived := 0
+	for scanner.Scan() {
+		var record retention.ArchivedInvoice
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("decoding archive line: %v", err)
+		}
+		if len(record.Transactions) != 1 || record.Transactions[0].Id != record.Id+"-tx" {
+			t.Errorf("%s archived with transactions %+v", record.Id, record.Transactions)
+		}
+		if len(record.History) != 1 || record.History[0].Id != record.Id+"-history" {
+			t.Errorf("%s archived with history %+v", record.Id, record.History)
+		}
+		if len(record.Callbacks) != 1 || record.Callbacks[0].Id != record.Id+"-callback" {
+			t.Errorf("%s archived with callbacks %+v", record.Id, record.Callbacks)
+		}
+		if _, err := store.FetchInvoiceById(record.Id); err != sql.ErrNoRows {
+			t.Errorf("fetching archived %s: got %v, want %v", record.Id, err, sql.ErrNoRows)
+		}
+		archived++
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("reading archive: %v", err)
+	}
+	if archived != 2 {
+		t.Fatalf("archive holds %d invoices, want 2", archived)
+	}
+}
+
+// failingCallbackStore fails fetching callbacks, as the archive is written
+type failingCallbackStore struct {
+	database.Store
+}
+
+func (s failingCallbackStore) FetchCallbacksByInvoiceId(invoiceId string) ([]database.Callback, error) {
+	return nil, errors.New("connection lost")
+}
+
+func TestRetentionArchiveFailure(t *testing.T) {
+	store := database.NewTestStore(t)
+	saveSettledInvoices(t, store, "paid", 2, database.InvoiceStatusPaid)
+	server := retention.Server{
+		Database:          failingCallbackStore{store},
+		PaidInvoiceMonths: 12,
+		ArchivePath:       filepath.Join(t.TempDir(), "archive"),
+	}
+
+	// Invoices which didn't make it into the archive stay
+	report, err := server.Run(time.Now())
+	if err == nil {
+		t.Fatal("run succeeded without writing the archive")
+	}
+	if report.ArchivedInvoices != 0 {
+		t.Fatalf("reported %d archived invoices", report.ArchivedInvoices)
+	}
+	if paid := countInvoices(t, store, database.InvoiceStatusPaid); paid != 2 {
+		t.Fatalf("%d paid invoices left of 2", paid)
+	}
+	for _, id := range []string{"paid-0", "paid-1"} {
+		callbacks, err := store.FetchCallbacksByInvoiceId(id)
+		if err != nil || len(callbacks) != 1 {
+			t.Fatalf("fetching callbacks of %s: got %d, %v", id, len(callbacks), err)
+		}
+	}
+}
@@ -1,51 +1,337 @@
 package database
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"errors"
 	"fmt"
+	"net/url"
+	"os"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 )
 
-var connection *sql.DB
+var ErrMysqlTlsInvalid = errors.New("mysql-tls must be false, true, skip-verify or preferred")
 
 type Server struct {
-	MysqlAddress  string
-	MysqlPort     uint16
-	MysqlDatabase string
-	MysqlUser     string
-	MysqlPass     string
+	Backend           string
+	MaxOpenConns      int
+	MaxIdleConns      int
+	ConnMaxLifetime   time.Duration
+	ConnMaxIdleTime   time.Duration
+	ConnectAttempts   int
+	ConnectBackoff    time.Duration
+	ConnectBackoffMax time.Duration
+	HealthInterval    time.Duration
+	MysqlAddress      string
+	MysqlPort         uint16
+	MysqlDatabase     string
+	MysqlUser         string
+	MysqlPass         string
+	MysqlTls          string
+	MysqlTlsCa        string
+	MysqlTlsCert      string
+	MysqlTlsKey       string
+	PostgresAddress   string
+	PostgresPort      uint16
+	PostgresDatabase  string
+	PostgresUser      string
+	PostgresPass      string
+	PostgresSslMode   string
+	SqlitePath        string
+	EnvelopeKey       string
+	EnvelopeKeyFile   string
+	Migrate           bool
+	Store             Store
+	ready             chan struct{}
 }
 
 func NewServer() *Server {
-	return &Server{
-		MysqlAddress:  viper.GetString("mysql-address"),
-		MysqlPort:     viper.GetUint16("mysql-port"),
-		MysqlDatabase: viper.GetString("mysql-database"),
-		MysqlUser:     viper.GetString("mysql-user"),
-		MysqlPass:     viper.GetString("mysql-pass"),
+	server := Server{
+		Backend:           "mysql",
+		MaxOpenConns:      100,
+		MaxIdleConns:      10,
+		ConnMaxLifetime:   30 * time.Minute,
+		ConnMaxIdleTime:   5 * time.Minute,
+		ConnectBackoff:    time.Second,
+		ConnectBackoffMax: time.Minute,
+		HealthInterval:    10 * time.Second,
+		MysqlAddress:      viper.GetString("mysql-address"),
+		MysqlPort:         viper.GetUint16("mysql-port"),
+		MysqlDatabase:     viper.GetString("mysql-database"),
+		MysqlUser:         viper.GetString("mysql-user"),
+		MysqlPass:         viper.GetString("mysql-pass"),
+		MysqlTls:          viper.GetString("mysql-tls"),
+		MysqlTlsCa:        viper.GetString("mysql-tls-ca"),
+		MysqlTlsCert:      viper.GetString("mysql-tls-cert"),
+		MysqlTlsKey:       viper.GetString("mysql-tls-key"),
+		PostgresAddress:   viper.GetString("postgres-address"),
+		PostgresPort:      5432,
+		PostgresDatabase:  viper.GetString("postgres-database"),
+		PostgresUser:      viper.GetString("postgres-user"),
+		PostgresPass:      viper.GetString("postgres-pass"),
+		PostgresSslMode:   "require",
+		SqlitePath:        "pkt-checkout.db",
+		EnvelopeKey:       viper.GetString("envelope-key"),
+		EnvelopeKeyFile:   viper.GetString("envelope-key-file"),
+		Migrate:           true,
+		ready:             make(chan struct{}),
 	}
+
+	if viper.IsSet("database-backend") {
+		server.Backend = viper.GetString("database-backend")
+	}
+
+	if viper.IsSet("database-max-open-conns") {
+		server.MaxOpenConns = viper.GetInt("database-max-open-conns")
+	}
+
+	if viper.IsSet("database-max-idle-conns") {
+		server.MaxIdleConns = viper.GetInt("database-max-idle-conns")
+	}
+
+	if viper.IsSet("database-conn-max-lifetime") {
+		server.ConnMaxLifetime = time.Duration(viper.GetInt("database-conn-max-lifetime")) * time.Second
+	}
+
+	if viper.IsSet("database-conn-max-idle-time") {
+		server.ConnMaxIdleTime = time.Duration(viper.GetInt("database-conn-max-idle-time")) * time.Second
+	}
+
+	if viper.IsSet("database-connect-attempts") {
+		server.ConnectAttempts = viper.GetInt("database-connect-attempts")
+	}
+
+	if viper.IsSet("database-connect-backoff") {
+		server.ConnectBackoff = time.Duration(viper.GetInt("database-connect-backoff")) * time.Second
+	}
+
+	if viper.IsSet("database-connect-backoff-max") {
+		server.ConnectBackoffMax = time.Duration(viper.GetInt("database-connect-backoff-max")) * time.Second
+	}
+
+	if viper.IsSet("database-health-interval") {
+		server.HealthInterval = time.Duration(viper.GetInt("database-health-interval")) * time.Second
+	}
+
+	if viper.IsSet("postgres-port") {
+		server.PostgresPort = viper.GetUint16("postgres-port")
+	}
+
+	if viper.IsSet("postgres-sslmode") {
+		server.PostgresSslMode = viper.GetString("postgres-sslmode")
+	}
+
+	if viper.IsSet("sqlite-path") {
+		server.SqlitePath = viper.GetString("sqlite-path")
+	}
+
+	// mysql-migrate predates the other backends and is still honoured
+	if viper.IsSet("database-migrate") {
+		server.Migrate = viper.GetBool("database-migrate")
+	} else if viper.IsSet("mysql-migrate") {
+		server.Migrate = viper.GetBool("mysql-migrate")
+	}
+
+	return &server
 }
 
+// Start opens the store and prepares the database in the background, the
+// store reports itself unhealthy until Ready is closed. Only configuration
+// errors and errors the database itself reports are fatal.
 func (s *Server) Start() {
 	// Prepare connection
-	c, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true", s.MysqlUser, s.MysqlPass, s.MysqlAddress, s.MysqlPort, s.MysqlDatabase))
+	var dialect *dialect
+	var dataSourceName string
+	switch s.Backend {
+	case "mysql":
+		dialect = &mysqlDialect
+		var err error
+		if dataSourceName, err = s.mysqlDataSourceName(); err != nil {
+			log.Fatal().Err(err).Msg("Interpreting MySQL TLS configuration failed")
+		}
+	case "postgres":
+		dialect = &postgresDialect
+		dataSourceName = (&url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(s.PostgresUser, s.PostgresPass),
+			Host:     fmt.Sprintf("%s:%d", s.PostgresAddress, s.PostgresPort),
+			Path:     "/" + s.PostgresDatabase,
+			RawQuery: url.Values{"sslmode": {s.PostgresSslMode}}.Encode(),
+		}).String()
+	case "sqlite":
+		dialect = &sqliteDialect
+		dataSourceName = fmt.Sprintf("file:%s?_txlock=immediate&_busy_timeout=10000&_journal_mode=WAL", s.SqlitePath)
+	default:
+		log.Fatal().Str("backend", s.Backend).Msg("Interpreting database backend failed")
+	}
+	envelopeKey, err := LoadEnvelopeKey(s.EnvelopeKey, s.EnvelopeKeyFile)
+	if err == ErrEnvelopeKeyMissing {
+		log.Fatal().Msg("No envelope key configured, set envelope-key-file to a file holding the output of openssl rand -base64 32")
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("Loading envelope key failed")
+	}
+	envelope, err := newEnvelope(envelopeKey)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Loading envelope key failed")
+	}
+	c, err := sql.Open(dialect.driver, dataSourceName)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Creating database connection failed")
 	}
-	c.SetMaxOpenConns(100)
+	c.SetMaxOpenConns(s.MaxOpenConns)
+	c.SetMaxIdleConns(s.MaxIdleConns)
+	c.SetConnMaxLifetime(s.ConnMaxLifetime)
+	c.SetConnMaxIdleTime(s.ConnMaxIdleTime)
+
+	store := newSqlStore(c, dialect, envelope)
+	s.Store = store
+	go s.prepare(store)
+}
+
+// Ready is closed once the database is connected, migrated and its keys
+// are protected
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
 
-	// Validate connection
-	if err = c.Ping(); err != nil {
-		log.Fatal().Err(err).Msg("Establishing database connection failed")
+func (s *Server) prepare(store *sqlStore) {
+	for {
+		// Validate connection, waiting for databases starting alongside the backend
+		if err := s.connect(store.db); err != nil {
+			log.Fatal().Err(err).Msg("Establishing database connection failed")
+		}
+
+		// Bring the scheme up to date, or at least make sure it is
+		err := migrate(store.db, store.dialect, s.Migrate)
+		if err == nil {
+			// Keys and secrets are only stored hashed or sealed
+			if err = store.protectKeys(s.Migrate); err != nil && !s.connectionLost(store.db) {
+				log.Fatal().Err(err).Msg("Protecting account keys failed")
+			}
+		} else if !s.connectionLost(store.db) {
+			log.Fatal().Err(err).Msg("Migrating database scheme failed")
+		}
+		if err == nil {
+			break
+		}
+		log.Warn().Err(err).Msg("Preparing database interrupted by a lost connection, retrying")
 	}
 
-	connection = c
+	// Keep track of the connection, the servers degrade while it is lost
+	store.healthy.Store(true)
+	go s.monitor(store)
+	close(s.ready)
+}
+
+// connectionLost tells failures of an unreachable database, which are worth
+// retrying, from errors the database reported
+func (s *Server) connectionLost(c *sql.DB) bool {
+	return s.ping(c) != nil
+}
+
+// connect pings the database until it responds, backing off exponentially
+// between attempts, up to ConnectAttempts unless that is 0
+func (s *Server) connect(c *sql.DB) error {
+	backoff := s.ConnectBackoff
+	for attempt := 1; ; attempt++ {
+		err := s.ping(c)
+		if err == nil {
+			return nil
+		}
+		if s.ConnectAttempts > 0 && attempt >= s.ConnectAttempts {
+			return err
+		}
+
+		log.Warn().Err(err).Int("attempt", attempt).Dur("backoff", backoff).Msg("Establishing database connection failed, retrying")
+		time.Sleep(backoff)
+		backoff = min(2*backoff, s.ConnectBackoffMax)
+	}
 }
 
-func GetConnection() *sql.DB {
-	return connection
+func (s *Server) ping(c *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return c.PingContext(ctx)
+}
+
+func (s *Server) monitor(store *sqlStore) {
+	for {
+		time.Sleep(s.HealthInterval)
+
+		err := s.ping(store.db)
+		if healthy := err == nil; store.healthy.Swap(healthy) != healthy {
+			if healthy {
+				log.Info().Msg("Database connection restored")
+			} else {
+				log.Error().Err(err).Msg("Database connection lost")
+			}
+		}
+	}
+}
+
+func (s *Server) mysqlDataSourceName() (string, error) {
+	config := mysql.NewConfig()
+	config.User = s.MysqlUser
+	config.Passwd = s.MysqlPass
+	config.Net = "tcp"
+	config.Addr = fmt.Sprintf("%s:%d", s.MysqlAddress, s.MysqlPort)
+	config.DBName = s.MysqlDatabase
+	config.ParseTime = true
+
+	switch s.MysqlTls {
+	case "", "false":
+	case "skip-verify", "preferred":
+		config.TLSConfig = s.MysqlTls
+	case "true":
+		config.TLSConfig = "true"
+
+		// Servers with certificates of a private CA, or requiring clients to
+		// authenticate with a certificate
+		if len(s.MysqlTlsCa) > 0 || len(s.MysqlTlsCert) > 0 {
+			tlsConfig, err := s.mysqlTlsConfig()
+			if err != nil {
+				return "", err
+			}
+			if err = mysql.RegisterTLSConfig("pkt-checkout", tlsConfig); err != nil {
+				return "", err
+			}
+			config.TLSConfig = "pkt-checkout"
+		}
+	default:
+		return "", ErrMysqlTlsInvalid
+	}
+
+	return config.FormatDSN(), nil
+}
+
+func (s *Server) mysqlTlsConfig() (*tls.Config, error) {
+	tlsConfig := tls.Config{ServerName: s.MysqlAddress, MinVersion: tls.VersionTLS12}
+	if len(s.MysqlTlsCa) > 0 {
+		ca, err := os.ReadFile(s.MysqlTlsCa)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%s holds no PEM encoded certificates", s.MysqlTlsCa)
+		}
+	}
+	if len(s.MysqlTlsCert) > 0 {
+		certificate, err := tls.LoadX509KeyPair(s.MysqlTlsCert, s.MysqlTlsKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return &tlsConfig, nil
 }
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"database/sql"
+	"sync/atomic"
+)
+
+// executor is satisfied by both *sql.DB and *sql.Tx
+type executor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// sqlRepository implements the repositories on top of database/sql, either
+// on the connection pool or within a transaction
+type sqlRepository struct {
+	conn     executor
+	dialect  *dialect
+	envelope *envelope
+}
+
+func (r *sqlRepository) connection() executor {
+	return boundExecutor{executor: r.conn, dialect: r.dialect}
+}
+
+// transact runs work in a transaction of its own, or in the one of the
+// unit of work the repository belongs to
+func (r *sqlRepository) transact(work func(dbTx executor) error) error {
+	db, ok := r.conn.(*sql.DB)
+	if !ok {
+		return work(r.connection())
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := work(boundExecutor{executor: tx, dialect: r.dialect}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+var (
+	_ Store      = (*sqlStore)(nil)
+	_ UnitOfWork = (*sqlUnitOfWork)(nil)
+)
+
+type sqlStore struct {
+	sqlRepository
+	db      *sql.DB
+	healthy atomic.Bool
+}
+
+func newSqlStore(db *sql.DB, dialect *dialect, envelope *envelope) *sqlStore {
+	return &sqlStore{sqlRepository: sqlRepository{conn: db, dialect: dialect, envelope: envelope}, db: db}
+}
+
+// InUnitOfWork runs work in a unit of work, committing if it succeeds and
+// rolling back otherwise
+func (s *sqlStore) InUnitOfWork(work func(uow UnitOfWork) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	uow := sqlUnitOfWork{sqlRepository: sqlRepository{conn: tx, dialect: s.dialect, envelope: s.envelope}}
+	if err := work(&uow); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, f := range uow.afterCommit {
+		f()
+	}
+
+	return nil
+}
+
+// Healthy reports whether the database responded to the latest health check
+func (s *sqlStore) Healthy() bool {
+	return s.healthy.Load()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+type sqlUnitOfWork struct {
+	sqlRepository
+	afterCommit []func()
+}
+
+// AfterCommit registers a function to run once the unit of work committed
+func (u *sqlUnitOfWork) AfterCommit(f func()) {
+	u.afterCommit = append(u.afterCommit, f)
+}
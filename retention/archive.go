@@ -0,0 +1,110 @@
+package retention
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"pkt-checkout/database"
+	"time"
+)
+
+// ArchivedInvoice is one line of an archive, the invoice with everything
+// removed along with it
+type ArchivedInvoice struct {
+	database.Invoice
+	Transactions []database.WalletTransaction `json:"transactions"`
+	History      []database.InvoiceHistory    `json:"history"`
+	Callbacks    []database.Callback          `json:"callbacks"`
+}
+
+// archiveInvoices writes paid invoices to a gzip compressed JSONL file before
+// removing them. Every batch is a gzip member of its own, synced before its
+// invoices are removed, so a failed run leaves at most a truncated last
+// member of invoices still in the database.
+func (s *Server) archiveInvoices(before time.Time, now time.Time) (int, string, error) {
+	archived := 0
+	var file *os.File
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	for {
+		offset := 0
+		if s.DryRun {
+			offset = archived
+		}
+		invoices, err := s.Database.FetchSettledInvoicesBefore(database.InvoiceStatusPaid, before, batchSize, offset)
+		if err != nil || len(invoices) == 0 {
+			return archived, archiveName(file), err
+		}
+		if s.DryRun {
+			archived += len(invoices)
+			continue
+		}
+
+		// Only runs archiving anything leave a file behind
+		if file == nil {
+			if file, err = s.createArchive(now); err != nil {
+				return archived, "", err
+			}
+		}
+		if err = s.writeArchive(file, invoices); err != nil {
+			return archived, archiveName(file), err
+		}
+
+		for _, invoice := range invoices {
+			err := s.Database.InUnitOfWork(func(uow database.UnitOfWork) error {
+				return uow.DeleteInvoice(&invoice)
+			})
+			if err != nil {
+				return archived, archiveName(file), err
+			}
+			archived++
+		}
+	}
+}
+
+func (s *Server) createArchive(now time.Time) (*os.File, error) {
+	// Archives hold customer data, readable by the backend only
+	if err := os.MkdirAll(s.ArchivePath, 0700); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(s.ArchivePath, fmt.Sprintf("invoices-%s.jsonl.gz", now.UTC().Format("20060102T150405Z")))
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+func (s *Server) writeArchive(file *os.File, invoices []database.Invoice) error {
+	writer := gzip.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, invoice := range invoices {
+		record := ArchivedInvoice{Invoice: invoice}
+		var err error
+		if record.Transactions, err = s.Database.FetchWalletTransactionsByInvoiceId(invoice.Id); err != nil {
+			return err
+		}
+		if record.History, err = s.Database.FetchInvoiceHistoryByInvoiceId(invoice.Id); err != nil {
+			return err
+		}
+		if record.Callbacks, err = s.Database.FetchCallbacksByInvoiceId(invoice.Id); err != nil {
+			return err
+		}
+		if err = encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func archiveName(file *os.File) string {
+	if file == nil {
+		return ""
+	}
+	return file.Name()
+}
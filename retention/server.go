@@ -0,0 +1,183 @@
+package retention
+
+import (
+	"pkt-checkout/database"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Records are processed in batches to keep transactions and memory small
+const batchSize = 500
+
+type Server struct {
+	Database           database.Store
+	ExpiredInvoiceDays int
+	PaidInvoiceMonths  int
+	CallbackDays       int
+	ArchivePath        string
+	Interval           time.Duration
+	DryRun             bool
+}
+
+// Report counts the records a run removed, or would have in a dry run
+type Report struct {
+	DryRun           bool   `json:"dryRun"`
+	PurgedInvoices   int    `json:"purgedInvoices"`
+	ArchivedInvoices int    `json:"archivedInvoices"`
+	PurgedCallbacks  int    `json:"purgedCallbacks"`
+	Archive          string `json:"archive,omitempty"`
+}
+
+func NewServer(store database.Store) *Server {
+	server := Server{
+		Database:    store,
+		ArchivePath: "archive",
+		Interval:    24 * time.Hour,
+	}
+
+	if viper.IsSet("retention-expired-invoices") {
+		server.ExpiredInvoiceDays = viper.GetInt("retention-expired-invoices")
+	}
+
+	if viper.IsSet("retention-paid-invoices") {
+		server.PaidInvoiceMonths = viper.GetInt("retention-paid-invoices")
+	}
+
+	if viper.IsSet("retention-callbacks") {
+		server.CallbackDays = viper.GetInt("retention-callbacks")
+	}
+
+	if viper.IsSet("retention-archive-path") {
+		server.ArchivePath = viper.GetString("retention-archive-path")
+	}
+
+	if viper.IsSet("retention-interval") {
+		server.Interval = time.Duration(viper.GetInt("retention-interval")) * time.Hour
+	}
+
+	if viper.IsSet("retention-dry-run") {
+		server.DryRun = viper.GetBool("retention-dry-run")
+	}
+
+	if server.ExpiredInvoiceDays < 0 || server.PaidInvoiceMonths < 0 || server.CallbackDays < 0 || server.Interval <= 0 {
+		log.Fatal().Msg("Interpreting retention policy failed")
+	}
+
+	return &server
+}
+
+// Enabled reports whether any retention policy is configured, all records
+// are kept forever otherwise
+func (s *Server) Enabled() bool {
+	return s.ExpiredInvoiceDays > 0 || s.PaidInvoiceMonths > 0 || s.CallbackDays > 0
+}
+
+func (s *Server) Start() {
+	for {
+		report, err := s.Run(time.Now())
+		event := log.Info()
+		if err != nil {
+			event = log.Error().Err(err)
+		}
+		event.Bool("dryRun", report.DryRun).
+			Int("purgedInvoices", report.PurgedInvoices).
+			Int("archivedInvoices", report.ArchivedInvoices).
+			Int("purgedCallbacks", report.PurgedCallbacks).
+			Str("archive", report.Archive).
+			Msg("Applying retention policies finished")
+		time.Sleep(s.Interval)
+	}
+}
+
+// Run applies the retention policies to the records settled before now,
+// reporting what it removed
+func (s *Server) Run(now time.Time) (Report, error) {
+	report := Report{DryRun: s.DryRun}
+	var err error
+
+	// Archive paid invoices first, their callbacks go into the archive
+	if s.PaidInvoiceMonths > 0 {
+		before := now.AddDate(0, -s.PaidInvoiceMonths, 0)
+		if report.ArchivedInvoices, report.Archive, err = s.archiveInvoices(before, now); err != nil {
+			return report, err
+		}
+	}
+
+	// Expired invoices were never paid, there is nothing worth keeping
+	if s.ExpiredInvoiceDays > 0 {
+		before := now.AddDate(0, 0, -s.ExpiredInvoiceDays)
+		if report.PurgedInvoices, err = s.purgeInvoices(database.InvoiceStatusExpired, before); err != nil {
+			return report, err
+		}
+	}
+
+	if s.CallbackDays > 0 {
+		before := now.AddDate(0, 0, -s.CallbackDays)
+		if report.PurgedCallbacks, err = s.purgeCallbacks(before); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+func (s *Server) purgeInvoices(status database.InvoiceStatus, before time.Time) (int, error) {
+	purged := 0
+	for {
+		// Removed invoices leave the result, dry runs page past them instead
+		offset := 0
+		if s.DryRun {
+			offset = purged
+		}
+		invoices, err := s.Database.FetchSettledInvoicesBefore(status, before, batchSize, offset)
+		if err != nil {
+			return purged, err
+		}
+		if len(invoices) == 0 {
+			return purged, nil
+		}
+
+		for _, invoice := range invoices {
+			if !s.DryRun {
+				err := s.Database.InUnitOfWork(func(uow database.UnitOfWork) error {
+					return uow.DeleteInvoice(&invoice)
+				})
+				if err != nil {
+					return purged, err
+				}
+			}
+			purged++
+		}
+	}
+}
+
+func (s *Server) purgeCallbacks(before time.Time) (int, error) {
+	purged := 0
+	for {
+		offset := 0
+		if s.DryRun {
+			offset = purged
+		}
+		callbacks, err := s.Database.FetchSettledCallbacksBefore(before, batchSize, offset)
+		if err != nil {
+			return purged, err
+		}
+		if len(callbacks) == 0 {
+			return purged, nil
+		}
+
+		for _, callback := range callbacks {
+			if !s.DryRun {
+				err := s.Database.InUnitOfWork(func(uow database.UnitOfWork) error {
+					return uow.DeleteCallback(&callback)
+				})
+				if err != nil {
+					return purged, err
+				}
+			}
+			purged++
+		}
+	}
+}
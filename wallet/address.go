@@ -0,0 +1,69 @@
+package wallet
+
+import "strings"
+
+const (
+	pktAddressPrefix  = "pkt"
+	bech32Charset     = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+	bech32ChecksumLen = 6
+)
+
+// IsPktAddress accepts native segwit version 0 addresses of the PKT chain,
+// as handed out by the wallet, by their bech32 checksum and program length
+func IsPktAddress(address string) bool {
+	if address != strings.ToLower(address) || !strings.HasPrefix(address, pktAddressPrefix+"1") {
+		return false
+	}
+
+	// Decode the data part
+	encoded := address[len(pktAddressPrefix)+1:]
+	if len(encoded) < 1+bech32ChecksumLen {
+		return false
+	}
+	data := make([]byte, len(encoded))
+	for j := range encoded {
+		value := strings.IndexByte(bech32Charset, encoded[j])
+		if value < 0 {
+			return false
+		}
+		data[j] = byte(value)
+	}
+	if bech32Polymod(append(bech32ExpandPrefix(pktAddressPrefix), data...)) != 1 {
+		return false
+	}
+
+	// Witness version 0 followed by a 20 or 32 byte program
+	if data[0] != 0 {
+		return false
+	}
+	bits := (len(data) - 1 - bech32ChecksumLen) * 5
+	program := bits / 8
+	return (program == 20 || program == 32) && bits%8 < 5
+}
+
+func bech32ExpandPrefix(prefix string) []byte {
+	expanded := make([]byte, 0, len(prefix)*2+1)
+	for j := range prefix {
+		expanded = append(expanded, prefix[j]>>5)
+	}
+	expanded = append(expanded, 0)
+	for j := range prefix {
+		expanded = append(expanded, prefix[j]&31)
+	}
+	return expanded
+}
+
+func bech32Polymod(values []byte) uint32 {
+	generator := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	checksum := uint32(1)
+	for _, value := range values {
+		top := checksum >> 25
+		checksum = (checksum&0x1ffffff)<<5 ^ uint32(value)
+		for j := 0; j < 5; j++ {
+			if (top>>j)&1 == 1 {
+				checksum ^= generator[j]
+			}
+		}
+	}
+	return checksum
+}
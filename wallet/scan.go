@@ -1,15 +1,17 @@
 package wallet
 
 import (
+	"errors"
+	"pkt-checkout/callback"
 	"pkt-checkout/database"
 	"time"
-
-	"github.com/google/uuid"
 )
 
+var ErrInvoiceNotPending = errors.New("invoice is no longer awaiting payment")
+
 func (s *Server) Scan() {
 	// Fetch invoices that require wallet backend scanning
-	invoices, err := database.FetchPendingInvoices()
+	invoices, err := s.Database.FetchPendingInvoices()
 	if err != nil {
 		return
 	}
@@ -22,97 +24,119 @@ func (s *Server) Scan() {
 
 	// Update states on invoices as necessary
 	for _, invoice := range invoices {
-		// Fetch transactions from database
-		dbTransactions, err := database.FetchWalletTransactionsByInvoiceId(invoice.Id)
-		if err != nil {
-			continue
-		}
+		s.scanInvoice(invoice, wbTransactions)
+	}
+}
 
-		// Filter transactions from wallet backend
-		var invoiceWbTransactions []BlockchainTransaction
-		for _, tx := range wbTransactions {
-			if invoice.PaymentAddress == tx.WalletAddress {
-				invoiceWbTransactions = append(invoiceWbTransactions, tx)
-			}
-		}
+// Rescan updates the state of a single invoice right away instead of
+// waiting for the next scan
+func (s *Server) Rescan(invoiceId string) (database.Invoice, error) {
+	invoice, err := s.Database.FetchInvoiceById(invoiceId)
+	if err != nil {
+		return invoice, err
+	}
+	if invoice.Status != database.InvoiceStatusCreated && invoice.Status != database.InvoiceStatusPending {
+		return invoice, ErrInvoiceNotPending
+	}
 
-		// Invoice has definitely expired
-		if invoice.ExpirationTime.Before(time.Now()) && len(dbTransactions) == 0 && len(invoiceWbTransactions) == 0 {
-			invoice.Status = "expired"
-			invoice.Update()
-
-			database.ReleaseLRUWalletAddress(invoice.PaymentAddress)
-
-			// Request callback
-			if len(invoice.CallbackUrl) > 0 {
-				var callback database.Callback
-				callback.Id = uuid.New().String()
-				callback.InvoiceId = invoice.Id
-				callback.RequestTime = time.Now()
-				callback.NextReqTime = time.Now()
-				callback.ReqErrors = 0
-				callback.Status = database.CallbackStatusCreated
-				callback.Save()
-			}
+	wbTransactions, err := s.getTransactions()
+	if err != nil {
+		return invoice, err
+	}
+	s.scanInvoice(invoice, wbTransactions)
 
-			continue
-		}
+	return s.Database.FetchInvoiceById(invoiceId)
+}
 
-		// Invoice has received at least one transaction
-		if invoice.Status == "created" && len(invoiceWbTransactions) > 0 {
-			invoice.Status = "pending"
-			invoice.Update()
+func (s *Server) scanInvoice(invoice database.Invoice, wbTransactions []BlockchainTransaction) {
+	// Fetch transactions from database
+	dbTransactions, err := s.Database.FetchWalletTransactionsByInvoiceId(invoice.Id)
+	if err != nil {
+		return
+	}
+
+	// Filter transactions from wallet backend
+	var invoiceWbTransactions []BlockchainTransaction
+	for _, tx := range wbTransactions {
+		if invoice.PaymentAddress == tx.WalletAddress {
+			invoiceWbTransactions = append(invoiceWbTransactions, tx)
 		}
+	}
 
-		// Persist wallet backend transactions
-		for _, tx := range invoiceWbTransactions {
-			persistTx := true
-			for _, txDb := range dbTransactions {
-				if tx.Id == txDb.Id {
-					persistTx = false
-					break
-				}
+	// Invoice has definitely expired
+	if invoice.ExpirationTime.Before(time.Now()) && len(dbTransactions) == 0 && len(invoiceWbTransactions) == 0 {
+		// Expire, release the address and request callback atomically, or retry next scan
+		s.Database.InUnitOfWork(func(uow database.UnitOfWork) error {
+			if err := uow.TransitionInvoice(&invoice, database.InvoiceStatusExpired); err != nil {
+				return err
 			}
-			if persistTx {
-				if tx.Confirmations >= s.TxConfirmations {
-					var walletTransaction database.WalletTransaction
-					walletTransaction.Id = tx.Id
-					walletTransaction.InvoiceId = invoice.Id
-					walletTransaction.WalletAddress = tx.WalletAddress
-					walletTransaction.PaymentAmount = tx.PaymentAmount
-					walletTransaction.DiscoveryTime = time.Unix(int64(tx.DiscoveryTime), 0)
-					walletTransaction.ConfirmationTime = time.Now()
-					walletTransaction.Save()
-				}
+			if err := uow.ReleaseLRUWalletAddress(invoice.PaymentAddress); err != nil {
+				return err
 			}
-		}
+			return callback.EnqueueCallback(uow, invoice, database.CallbackEventInvoiceExpired)
+		})
+
+		return
+	}
 
-		// Fetch the sum of all payments made towards the invoice
-		paymentAmountSum, err := database.FetchPaymentAmountSumForInvoiceId(invoice.Id)
+	// Invoice has received at least one transaction
+	if invoice.Status == database.InvoiceStatusCreated && len(invoiceWbTransactions) > 0 {
+		err := s.Database.InUnitOfWork(func(uow database.UnitOfWork) error {
+			if err := uow.TransitionInvoice(&invoice, database.InvoiceStatusPending); err != nil {
+				return err
+			}
+			return callback.EnqueueCallback(uow, invoice, database.CallbackEventInvoicePaymentDetected)
+		})
 		if err != nil {
-			continue
+			return
 		}
+	}
 
-		// Invoice may have been paid at this point
-		if paymentAmountSum >= invoice.PaymentAmount {
-			invoice.Status = "paid"
-			invoice.Update()
-
-			database.ReleaseLRUWalletAddress(invoice.PaymentAddress)
-
-			// Request callback
-			if len(invoice.CallbackUrl) > 0 {
-				var callback database.Callback
-				callback.Id = uuid.New().String()
-				callback.InvoiceId = invoice.Id
-				callback.RequestTime = time.Now()
-				callback.NextReqTime = time.Now()
-				callback.ReqErrors = 0
-				callback.Status = database.CallbackStatusCreated
-				callback.Save()
+	// Persist wallet backend transactions
+	for _, tx := range invoiceWbTransactions {
+		persistTx := true
+		for _, txDb := range dbTransactions {
+			if tx.Id == txDb.Id {
+				persistTx = false
+				break
 			}
-
-			continue
 		}
+		if persistTx {
+			if tx.Confirmations >= s.TxConfirmations {
+				var walletTransaction database.WalletTransaction
+				walletTransaction.Id = tx.Id
+				walletTransaction.InvoiceId = invoice.Id
+				walletTransaction.WalletAddress = tx.WalletAddress
+				walletTransaction.PaymentAmount = tx.PaymentAmount
+				walletTransaction.DiscoveryTime = time.Unix(int64(tx.DiscoveryTime), 0)
+				walletTransaction.ConfirmationTime = time.Now()
+				s.Database.InUnitOfWork(func(uow database.UnitOfWork) error {
+					if err := uow.SaveWalletTransaction(&walletTransaction); err != nil {
+						return err
+					}
+					return callback.EnqueueCallback(uow, invoice, database.CallbackEventInvoicePaymentConfirmed)
+				})
+			}
+		}
+	}
+
+	// Fetch the sum of all payments made towards the invoice
+	paymentAmountSum, err := s.Database.FetchPaymentAmountSumForInvoiceId(invoice.Id)
+	if err != nil {
+		return
+	}
+
+	// Invoice may have been paid at this point
+	if paymentAmountSum >= invoice.PaymentAmount {
+		// Settle, release the address and request callback atomically, or retry next scan
+		s.Database.InUnitOfWork(func(uow database.UnitOfWork) error {
+			if err := uow.TransitionInvoice(&invoice, database.InvoiceStatusPaid); err != nil {
+				return err
+			}
+			if err := uow.ReleaseLRUWalletAddress(invoice.PaymentAddress); err != nil {
+				return err
+			}
+			return callback.EnqueueCallback(uow, invoice, database.CallbackEventInvoicePaid)
+		})
 	}
 }
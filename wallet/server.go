@@ -2,6 +2,8 @@ package wallet
 
 import (
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"net/http"
 	"pkt-checkout/database"
 	"time"
@@ -10,7 +12,10 @@ import (
 	"github.com/spf13/viper"
 )
 
+var ErrAddressesInconsistent = errors.New("database holds addresses unknown to the wallet backend")
+
 type Server struct {
+	Database        database.Store
 	RpcClient       *http.Client
 	RpcAddress      string
 	RpcPort         uint16
@@ -20,8 +25,9 @@ type Server struct {
 	TxConfirmations uint32
 }
 
-func NewServer() *Server {
+func NewServer(store database.Store) *Server {
 	return &Server{
+		Database: store,
 		RpcClient: &http.Client{
 			Transport: &http.Transport{
 				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
@@ -37,26 +43,39 @@ func NewServer() *Server {
 }
 
 func (s *Server) Start() {
-	db := database.GetConnection()
+	// Wait for the wallet and database backends, e.g. when started alongside them
+	backoff := time.Second
+	for {
+		err := s.prepareAddresses()
+		if err == nil {
+			break
+		}
+		if err == ErrAddressesInconsistent {
+			log.Fatal().Err(err).Msg("Inconsistency between wallet backend and database backend")
+		}
+
+		log.Warn().Err(err).Dur("backoff", backoff).Msg("Preparing addresses failed, retrying")
+		time.Sleep(backoff)
+		backoff = min(2*backoff, time.Minute)
+	}
 
+	for {
+		s.Scan()
+		time.Sleep(30 * time.Second)
+	}
+}
+
+func (s *Server) prepareAddresses() error {
 	// Fetch addresses from wallet
 	walletAddresses, err := s.getWalletAddresses()
 	if err != nil {
-		log.Fatal().Err(err).Msg("Fetching addresses from wallet backend failed")
+		return fmt.Errorf("fetching addresses from wallet backend: %w", err)
 	}
 
 	// Fetch addresses from database
-	dbResults, err := db.Query("SELECT address FROM walletAddresses")
+	dbAddresses, err := s.Database.FetchWalletAddresses()
 	if err != nil {
-		log.Fatal().Err(err).Msg("Fetching addresses from database backend failed")
-	}
-
-	// Loading the data
-	var dbAddresses []string
-	for dbResults.Next() {
-		var address string
-		dbResults.Scan(&address)
-		dbAddresses = append(dbAddresses, address)
+		return fmt.Errorf("fetching addresses from database backend: %w", err)
 	}
 
 	// Consistency check
@@ -69,33 +88,36 @@ func (s *Server) Start() {
 			}
 		}
 		if !addressFound {
-			log.Fatal().Err(err).Msg("Inconsistency between wallet backend and database backend")
+			return ErrAddressesInconsistent
 		}
 	}
 
 	// Generate missing addresses
 	if len(dbAddresses) < s.TxAddresses {
-		for j := 0; j < (s.TxAddresses - len(dbAddresses)); j++ {
-			// Wallet backend
-			address, err := s.getNewAddress()
-			if err != nil {
-				log.Fatal().Err(err).Msg("Generating missing addresses failed")
-			}
-
-			// Database backend
-			stmt, err := db.Prepare("INSERT INTO walletAddresses (address) VALUES (?)")
-			if err != nil {
-				log.Fatal().Err(err).Msg("Generating missing addresses failed")
-			}
-			_, err = stmt.Exec(address)
-			if err != nil {
-				log.Fatal().Err(err).Msg("Generating missing addresses failed")
-			}
+		if _, err := s.GenerateAddresses(s.TxAddresses - len(dbAddresses)); err != nil {
+			return fmt.Errorf("generating missing addresses: %w", err)
 		}
 	}
 
-	for {
-		s.Scan()
-		time.Sleep(30 * time.Second)
+	return nil
+}
+
+// GenerateAddresses adds new addresses of the wallet backend to the pool
+// invoices are assigned from
+func (s *Server) GenerateAddresses(count int) ([]string, error) {
+	var addresses []string
+	for j := 0; j < count; j++ {
+		// Wallet backend
+		address, err := s.getNewAddress()
+		if err != nil {
+			return addresses, err
+		}
+
+		// Database backend
+		if err = s.Database.SaveWalletAddress(address); err != nil {
+			return addresses, err
+		}
+		addresses = append(addresses, address)
 	}
+	return addresses, nil
 }
@@ -0,0 +1,92 @@
+package webhook
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var body = []byte(`{"id":"7d3c7e2e-6b8f-4a8e-9a44-0cbd1f5e1b9a","status":"paid"}`)
+
+func TestSignVerify(t *testing.T) {
+	header := Sign(body, time.Now(), "secret")
+	if !strings.HasPrefix(header, "t=") || strings.Count(header, ",v1=") != 1 {
+		t.Fatalf("unexpected header %q", header)
+	}
+	if err := Verify(body, header, 5*time.Minute, "secret"); err != nil {
+		t.Fatalf("verifying own signature: %v", err)
+	}
+	if err := Verify(body, header, 5*time.Minute, "other"); !errors.Is(err, ErrNoSignature) {
+		t.Fatalf("verifying with another secret: got %v, want %v", err, ErrNoSignature)
+	}
+	tampered := append([]byte{}, body...)
+	tampered[len(tampered)-3] = 'X'
+	if err := Verify(tampered, header, 5*time.Minute, "secret"); !errors.Is(err, ErrNoSignature) {
+		t.Fatalf("verifying a tampered body: got %v, want %v", err, ErrNoSignature)
+	}
+}
+
+func TestVerifyTolerance(t *testing.T) {
+	tests := []struct {
+		name      string
+		timestamp time.Time
+		tolerance time.Duration
+		want      error
+	}{
+		{"within", time.Now().Add(-time.Minute), 5 * time.Minute, nil},
+		{"expired", time.Now().Add(-10 * time.Minute), 5 * time.Minute, ErrTimestampExpired},
+		{"future", time.Now().Add(10 * time.Minute), 5 * time.Minute, ErrTimestampExpired},
+		{"unchecked", time.Now().Add(-24 * time.Hour), 0, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := Sign(body, test.timestamp, "secret")
+			if err := Verify(body, header, test.tolerance, "secret"); !errors.Is(err, test.want) {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyRotation(t *testing.T) {
+	// Deliveries are signed with every active secret while rotating
+	header := Sign(body, time.Now(), "previous", "current")
+	if strings.Count(header, ",v1=") != 2 {
+		t.Fatalf("unexpected header %q", header)
+	}
+	for _, secret := range []string{"previous", "current"} {
+		if err := Verify(body, header, 5*time.Minute, secret); err != nil {
+			t.Fatalf("verifying with %s secret: %v", secret, err)
+		}
+	}
+
+	// Receivers may hold several secrets too
+	header = Sign(body, time.Now(), "current")
+	if err := Verify(body, header, 5*time.Minute, "previous", "current"); err != nil {
+		t.Fatalf("verifying with several secrets: %v", err)
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	valid := Sign(body, time.Now(), "secret")
+	timestamp, signature, _ := strings.Cut(valid, ",")
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"empty", ""},
+		{"missing timestamp", signature},
+		{"missing signature", timestamp},
+		{"non-numeric timestamp", "t=now," + signature},
+		{"non-hex signature", timestamp + ",v1=zz" + signature[5:]},
+		{"missing separator", timestamp + ",v1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := Verify(body, test.header, 5*time.Minute, "secret"); !errors.Is(err, ErrInvalidHeader) {
+				t.Fatalf("got %v, want %v", err, ErrInvalidHeader)
+			}
+		})
+	}
+}